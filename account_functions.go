@@ -18,14 +18,18 @@ func getAccountSecret(account string) string {
 	return hex.EncodeToString(hash[:])
 }
 
-func hmacCall(call *data.Call) []byte {
+// hmacCall authenticates a call made on behalf of an account from an lnurl.
+// the nonce and the expiry make it usable only once and for a while, as these
+// calls can spend from the account balance.
+func hmacCall(call *data.Call, nonce string, expiry int64) []byte {
 	mac := hmac.New(sha256.New, []byte(getAccountSecret(call.Caller)))
-	mac.Write([]byte(callHmacString(call)))
+	mac.Write([]byte(callHmacString(call, nonce, expiry)))
 	return mac.Sum(nil)
 }
 
-func callHmacString(call *data.Call) (res string) {
-	res = fmt.Sprintf("%s:%s:%d,", call.ContractId, call.Method, call.Msatoshi)
+func callHmacString(call *data.Call, nonce string, expiry int64) (res string) {
+	res = fmt.Sprintf("%s:%s:%d:%s:%d,",
+		call.ContractId, call.Method, call.Msatoshi, nonce, expiry)
 
 	var payload map[string]interface{}
 	json.Unmarshal(call.Payload, &payload)
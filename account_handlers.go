@@ -71,10 +71,11 @@ func lnurlSession(w http.ResponseWriter, r *http.Request) {
 	if accountId != "" {
 		// we're logged already, so send account information
 		balance := data.GetAccountBalance(accountId)
+		reserved := data.GetAccountReserved(accountId)
 
 		go func() {
 			time.Sleep(100 * time.Millisecond)
-			es.SendEventMessage(`{"account": "`+accountId+`", "balance": `+strconv.FormatInt(balance, 10)+`, "can_withdraw": `+strconv.FormatInt(balanceWithReserve(balance), 10)+`, "secret": "`+getAccountSecret(accountId)+`"}`, "auth", "")
+			es.SendEventMessage(`{"account": "`+accountId+`", "balance": `+strconv.FormatInt(balance, 10)+`, "can_withdraw": `+strconv.FormatInt(balanceWithReserve(balance), 10)+`, "reserved": `+strconv.FormatInt(reserved, 10)+`, "secret": "`+getAccountSecret(accountId)+`"}`, "auth", "")
 		}()
 
 		// also renew this session
@@ -126,7 +127,7 @@ func lnurlAuth(w http.ResponseWriter, r *http.Request) {
 	es := ies.(eventsource.EventSource)
 
 	// notify browser
-	es.SendEventMessage(`{"session": "`+k1+`", "account": "`+key+`", "balance": `+strconv.FormatInt(data.GetAccountBalance(key), 10)+`, "secret": "`+getAccountSecret(key)+`"}`, "auth", "")
+	es.SendEventMessage(`{"session": "`+k1+`", "account": "`+key+`", "balance": `+strconv.FormatInt(data.GetAccountBalance(key), 10)+`, "reserved": `+strconv.FormatInt(data.GetAccountReserved(key), 10)+`, "secret": "`+getAccountSecret(key)+`"}`, "auth", "")
 
 	json.NewEncoder(w).Encode(lnurl.OkResponse())
 }
@@ -145,9 +146,10 @@ func refreshBalance(w http.ResponseWriter, r *http.Request) {
 
 	// get balance
 	balance := data.GetAccountBalance(accountId)
+	reserved := data.GetAccountReserved(accountId)
 
 	if ies, ok := userstreams.Get(session); ok {
-		ies.(eventsource.EventSource).SendEventMessage(`{"account": "`+accountId+`", "balance": `+strconv.FormatInt(balance, 10)+`, "can_withdraw": `+strconv.FormatInt(balanceWithReserve(balance), 10)+`, "secret": "`+getAccountSecret(accountId)+`"}`, "auth", "")
+		ies.(eventsource.EventSource).SendEventMessage(`{"account": "`+accountId+`", "balance": `+strconv.FormatInt(balance, 10)+`, "can_withdraw": `+strconv.FormatInt(balanceWithReserve(balance), 10)+`, "reserved": `+strconv.FormatInt(reserved, 10)+`, "secret": "`+getAccountSecret(accountId)+`"}`, "auth", "")
 	}
 
 	w.WriteHeader(200)
@@ -1,10 +1,17 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/fiatjaf/etleneum/data"
@@ -19,10 +26,14 @@ var balanceNotifyClient = http.Client{
 }
 
 type CallContext struct {
-	VisitedContracts map[string]bool
-	Transfers        []data.Transfer
-	Funds            map[string]int64
-	AccountBalances  map[string]int64
+	Running         map[string]bool // contracts in the middle of a call
+	Depth           int             // of the call currently running
+	Funds           map[string]int64
+	AccountBalances map[string]int64
+	Calls           []*data.Call // all calls that have run, in order
+	Schedules       []data.Schedule
+	Holds           map[string]*data.Hold                 // changed holds, Msatoshi is 0 when they are gone
+	Storage         map[string]map[string]json.RawMessage // changed keys, nil when deleted
 }
 
 func getCallCosts(c data.Call, isLnurl bool) int64 {
@@ -33,9 +44,34 @@ func getCallCosts(c data.Call, isLnurl bool) int64 {
 		cost += 10 * chars // 50 msatoshi for each character in the payload
 	}
 
+	if s.MillionGasCostSatoshis > 0 {
+		// the full gas budget is paid upfront
+		gas := c.GasLimit
+		if gas <= 0 || gas > s.CallGasLimit {
+			gas = s.CallGasLimit
+		}
+		cost += gas * s.MillionGasCostSatoshis / 1000
+	}
+
 	return cost
 }
 
+// checkCallPayload validates the payload against the annotations of the
+// method, so invalid calls are rejected before an invoice is made. it returns
+// the method so the caller can check its price.
+func checkCallPayload(call *data.Call) (method *data.Method, err error) {
+	ct, _ := data.GetContract(call.ContractId)
+	if ct == nil {
+		return nil, errors.New("contract not found")
+	}
+
+	method = ct.GetMethod(call.Method)
+	if method == nil || method.Schema == nil {
+		return method, nil
+	}
+	return method, method.Schema.Validate(call.Payload)
+}
+
 func callFromRedis(callid string) (call *data.Call, err error) {
 	var jcall []byte
 	call = &data.Call{}
@@ -67,16 +103,33 @@ func saveCallOnRedis(call data.Call) (jcall []byte, err error) {
 	return
 }
 
-func runCallGlobal(call *data.Call, useBalance bool) (err error) {
-	// initialize context
-	callContext := &CallContext{
-		VisitedContracts: make(map[string]bool),
-		Funds:            make(map[string]int64),
-		AccountBalances:  make(map[string]int64),
+func newCallContext() *CallContext {
+	return &CallContext{
+		Running:         make(map[string]bool),
+		Funds:           make(map[string]int64),
+		AccountBalances: make(map[string]int64),
+		Holds:           make(map[string]*data.Hold),
+		Storage:         make(map[string]map[string]json.RawMessage),
 	}
+}
+
+func runCallGlobal(ctx context.Context, call *data.Call, useBalance bool) (err error) {
+	// the whole chain of calls must finish before this
+	ctx, cancel := context.WithTimeout(ctx, time.Second*15)
+	defer cancel()
+
+	// the time is what the contract sees in os.time(), it is never taken from
+	// the client. calls made by this one inherit it.
+	call.Time = time.Unix(time.Now().Unix(), 0)
+
+	// it is also the root of its tree of calls
+	call.Parent = nil
+
+	// initialize context
+	callContext := newCallContext()
 
 	// actually run the call
-	err = runCall(call, callContext, useBalance)
+	err = runCall(ctx, call, callContext, useBalance)
 	if err != nil {
 		return err
 	}
@@ -106,13 +159,35 @@ func runCallGlobal(call *data.Call, useBalance bool) (err error) {
 			return fmt.Errorf("error saving contract funds: %w", err)
 		}
 	}
+	for id, hold := range callContext.Holds {
+		if hold.Msatoshi == 0 {
+			// captured or released
+			if err := data.DeleteHold(hold.Account, id); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("error deleting hold: %w", err)
+			}
+			continue
+		}
 
-	if err := data.SaveTransfers(call, callContext.Transfers); err != nil {
-		return err
+		if err := data.SaveHold(*hold); err != nil {
+			return fmt.Errorf("error saving hold: %w", err)
+		}
 	}
 
-	// at this point the call has succeeded, we can then notify all accounts
-	// that have a balanceNotify URL set on their metadata
+	// at this point the call has succeeded, we can then dispatch the events
+	// emitted by all contracts involved
+	for _, c := range callContext.Calls {
+		for _, event := range c.Events {
+			dispatchContractEvent(c.ContractId,
+				emittedevent{c.Id, c.ContractId, event.Name, event.Data},
+				"contract-event")
+		}
+	}
+
+	for _, sch := range callContext.Schedules {
+		dispatchContractEvent(sch.ContractId, sch, "schedule-created")
+	}
+
+	// and notify all accounts that have a balanceNotify URL set on their metadata
 	go func() {
 		time.Sleep(2 * time.Second) // give some time for the call to be finished
 		for key, balance := range callContext.AccountBalances {
@@ -136,11 +211,24 @@ func runCallGlobal(call *data.Call, useBalance bool) (err error) {
 	return nil
 }
 
-func runCall(call *data.Call, callContext *CallContext, useBalance bool) (err error) {
-	if _, visited := callContext.VisitedContracts[call.ContractId]; visited {
-		// can't call a method on the same contract (for now?)
-		// (if this ever change see ##callswithsameid)
-		return errors.New("can't call a method on the same contract")
+func runCall(ctx context.Context, call *data.Call, callContext *CallContext, useBalance bool) (err error) {
+	// whatever the client has sent for these is discarded, they are only
+	// filled while the call runs
+	call.Result = nil
+	call.Events = nil
+	call.HTTP = nil
+	call.Random = nil
+	call.Queries = nil
+	call.Transfers = nil
+	call.Calls = nil
+
+	// a contract can be called many times in the same chain, but not while
+	// it is running, as its state would be overwritten when it finished
+	if callContext.Running[call.ContractId] {
+		return errors.New("can't call " + call.ContractId + ", it is already running")
+	}
+	if callContext.Depth >= s.CallMaxDepth {
+		return fmt.Errorf("maximum call depth of %d exceeded", s.CallMaxDepth)
 	}
 
 	// get contract data
@@ -149,10 +237,34 @@ func runCall(call *data.Call, callContext *CallContext, useBalance bool) (err er
 		return fmt.Errorf("failed to load contract %s: %w", call.ContractId, err)
 	}
 
-	callContext.VisitedContracts[call.ContractId] = true
+	if ct.Library {
+		return errors.New("can't call " + call.ContractId + ", it is a library")
+	}
+
+	callContext.Running[call.ContractId] = true
+	callContext.Depth++
+	defer func() {
+		delete(callContext.Running, call.ContractId)
+		callContext.Depth--
+	}()
+
+	// the contract may have been called or received funds earlier in the chain
+	funds, ok := callContext.Funds[call.ContractId]
+	if !ok {
+		funds = ct.Funds
+	}
+	callContext.Funds[call.ContractId] = funds + call.Msatoshi
 
 	// pay for this with the caller's balance?
-	if call.Caller != "" && useBalance {
+	if call.Caller == call.ContractId && useBalance {
+		// a call scheduled by the contract itself, paid with its own funds
+		callContext.Funds[call.ContractId] -= call.Cost
+		call.Transfers = append(call.Transfers, data.Transfer{
+			From:     call.ContractId,
+			To:       "",
+			Msatoshi: call.Cost,
+		})
+	} else if call.Caller != "" && useBalance {
 		// burn amount corresponding to the call msatoshi + call cost.
 		// we don't transfer to the contract directly
 		// because the call already has the msatoshi amount assigned to it and that
@@ -171,137 +283,363 @@ func runCall(call *data.Call, callContext *CallContext, useBalance bool) (err er
 		}
 
 		callContext.AccountBalances[call.Caller] = balance - (call.Msatoshi + call.Cost)
-		callContext.Transfers = append(callContext.Transfers, data.Transfer{
+		call.Transfers = append(call.Transfers, data.Transfer{
 			From:     call.Caller,
 			To:       "",
 			Msatoshi: call.Cost,
 		})
-		callContext.Transfers = append(callContext.Transfers, data.Transfer{
+		call.Transfers = append(call.Transfers, data.Transfer{
 			From:     call.Caller,
 			To:       call.ContractId,
 			Msatoshi: call.Msatoshi,
 		})
 	} else {
 		// take note of the amount sent in this call as a transfer
-		callContext.Transfers = append(callContext.Transfers, data.Transfer{
+		call.Transfers = append(call.Transfers, data.Transfer{
 			From:     "",
 			To:       call.ContractId,
 			Msatoshi: call.Msatoshi,
 		})
 	}
 
-	callContext.Funds[call.ContractId] = ct.Funds + call.Msatoshi
+	call.Version = ct.Version
+
+	// the call time is what the contract sees in os.time(), so it is saved
+	if call.Time.IsZero() {
+		call.Time = time.Unix(time.Now().Unix(), 0)
+	}
+
+	// storage changes are kept here until the call succeeds
+	storage, ok := callContext.Storage[call.ContractId]
+	if !ok {
+		storage = make(map[string]json.RawMessage)
+		callContext.Storage[call.ContractId] = storage
+	}
 
 	// actually run the call
+	var schedules []data.Schedule
+	nholds := 0
 	dispatchContractEvent(call.ContractId, ctevent{call.Id, call.ContractId, call.Method, call.Msatoshi, "", "start"}, "call-run-event")
-	newStateO, err := runlua.RunCall(
+	newStateO, returned, gasUsed, err := runlua.RunCall(
+		ctx,
 		log,
 		&callPrinter{call.ContractId, call.Id, call.Method},
-		func(r *http.Request) (*http.Response, error) { return http.DefaultClient.Do(r) },
+		runlua.Callbacks{
+			MakeRequest:             recordRequests(call),
+			GetExternalContractData: getExternalContractData,
+			CallExternalMethod: func(externalContractId string, method string, payload interface{}, msatoshi int64, gasLimit int64) (result interface{}, gasUsed int64, err error) {
+				if len(method) == 0 || method[0] == '_' {
+					return nil, 0, errors.New("invalid method " + method)
+				}
 
-		// get external contract
-		func(contractId string) (state interface{}, funds int64, err error) {
-			ct, err := data.GetContract(contractId)
-			if err != nil {
-				return
-			}
-			err = json.Unmarshal(ct.State, &state)
-			if err != nil {
-				return
-			}
-			return state, ct.Funds, nil
-		},
+				jpayload, _ := json.Marshal(payload)
+
+				// build the call
+				externalCall := &data.Call{
+					ContractId: externalContractId,
+					Id:         data.SubCallId(call.Id, len(call.Calls)),
+					Method:     method,
+					Payload:    jpayload,
+					Msatoshi:   msatoshi,
+					Cost:       1000, // only the fixed cost, the other costs are included
+					Caller:     call.ContractId,
+					GasLimit:   gasLimit,
+					Time:       call.Time,
+					Parent:     &data.CallRef{ContractId: call.ContractId, Id: call.Id},
+				}
+				call.Calls = append(call.Calls, data.CallRef{
+					ContractId: externalCall.ContractId,
+					Id:         externalCall.Id,
+				})
+
+				// pay for the call (by burning msatoshis from the caller contract)
+				callContext.Funds[call.ContractId] -= (externalCall.Cost + externalCall.Msatoshi)
+				call.Transfers = append(call.Transfers, data.Transfer{
+					From:     call.ContractId,
+					To:       externalCall.ContractId,
+					Msatoshi: externalCall.Cost + externalCall.Msatoshi,
+				})
+
+				// then run
+				err = runCall(ctx, externalCall, callContext, false)
+				if err != nil {
+					return nil, 0, err
+				}
 
-		// call external method
-		func(externalContractId string, method string, payload interface{}, msatoshi int64) (err error) {
-			jpayload, _ := json.Marshal(payload)
-
-			// build the call
-			externalCall := &data.Call{
-				ContractId: externalContractId,
-				Id:         call.Id, // repeat the call id ##callswithsameid
-				// (since we won't do two calls with the same id on the same contract)
-				Method:   method,
-				Payload:  jpayload,
-				Msatoshi: msatoshi,
-				Cost:     1000, // only the fixed cost, the other costs are included
-				Caller:   call.ContractId,
-			}
+				// the caller gets the result as it is saved
+				result, err = decodeResult(externalCall.Result)
+				return result, externalCall.GasUsed, err
+			},
 
-			// pay for the call (by burning msatoshis from the caller contract)
-			callContext.Funds[call.ContractId] -= (externalCall.Cost + externalCall.Msatoshi)
-			callContext.Transfers = append(callContext.Transfers, data.Transfer{
-				From:     call.ContractId,
-				To:       externalCall.ContractId,
-				Msatoshi: externalCall.Cost + externalCall.Msatoshi,
-			})
+			QueryExternalMethod: func(externalContractId string, method string, payload interface{}, gasLimit int64) (result interface{}, gasUsed int64, err error) {
+				jpayload, _ := json.Marshal(payload)
+				jresult, gasUsed, err := queryExternal(ctx, call, callContext, externalContractId, method, jpayload, gasLimit)
+				if err != nil {
+					return nil, 0, err
+				}
 
-			// then run
-			err = runCall(externalCall, callContext, false)
-			if err != nil {
-				return err
-			}
+				// the result is saved so the call can be replayed
+				call.Queries = append(call.Queries, data.Query{
+					ContractId: externalContractId,
+					Method:     method,
+					Payload:    jpayload,
+					Result:     jresult,
+					GasUsed:    gasUsed,
+				})
+				result, err = decodeResult(jresult)
+				return result, gasUsed, err
+			},
+
+			GetContractFunds: func() (contractFunds int64, err error) {
+				ct, err := data.GetContract(ct.Id)
+				if err != nil {
+					return
+				}
+				return ct.Funds, nil
+			},
 
-			return nil
-		},
+			SendFromContract: func(target string, msat int64) (msatoshiSent int64, err error) {
+				if len(target) == 0 {
+					return 0, errors.New("can't send to blank recipient")
+				}
 
-		// get contract balance
-		func() (contractFunds int64, err error) {
-			ct, err := data.GetContract(ct.Id)
-			if err != nil {
-				return
-			}
-			return ct.Funds, nil
-		},
+				call.Transfers = append(call.Transfers, data.Transfer{
+					From:     call.ContractId,
+					To:       target,
+					Msatoshi: msat,
+				})
+				callContext.Funds[call.ContractId] -= msat
 
-		// send from contract
-		func(target string, msat int64) (msatoshiSent int64, err error) {
-			if len(target) == 0 {
-				return 0, errors.New("can't send to blank recipient")
-			}
+				if err := creditRecipient(callContext, target, msat); err != nil {
+					return 0, err
+				}
+
+				dispatchContractEvent(call.ContractId, ctevent{call.Id, call.ContractId, call.Method, call.Msatoshi, fmt.Sprintf("contract.send(%s, %d)", target, msat), "function"}, "call-run-event")
+				return msat, nil
+			},
+
+			EmitEvent: func(name string, payload interface{}) error {
+				if name == "" {
+					return errors.New("event name can't be blank")
+				}
+
+				jpayload, err := json.Marshal(payload)
+				if err != nil {
+					return fmt.Errorf("can't encode event data: %w", err)
+				}
+
+				call.Events = append(call.Events, data.Event{
+					Name: name,
+					Data: jpayload,
+					Time: call.Time,
+				})
+				return nil
+			},
+
+			ScheduleCall: func(method string, payload interface{}, at int64) (id string, err error) {
+				if len(method) == 0 || method[0] == '_' {
+					return "", errors.New("invalid method " + method)
+				}
 
-			callContext.Transfers = append(callContext.Transfers, data.Transfer{
-				From:     call.ContractId,
-				To:       target,
-				Msatoshi: msat,
-			})
-			callContext.Funds[call.ContractId] -= msat
-
-			if target[0] == 'c' {
-				// it's a contract
-				if current, ok := callContext.Funds[target]; ok {
-					callContext.Funds[target] = current + msat
-				} else {
-					targetContract, err := data.GetContract(target)
+				jpayload := []byte("{}")
+				if payload != nil {
+					jpayload, err = json.Marshal(payload)
 					if err != nil {
-						return 0, errors.New("contract " + target + " not found")
+						return "", fmt.Errorf("can't encode payload: %w", err)
 					}
-					callContext.Funds[target] = targetContract.Funds + msat
-				}
-			} else if target[0] == '0' {
-				// it's an account
-				if current, ok := callContext.AccountBalances[target]; ok {
-					callContext.AccountBalances[target] = current + msat
-				} else {
-					current := data.GetAccountBalance(target)
-					callContext.AccountBalances[target] = current + msat
-				}
-			} else {
-				return 0, errors.New("invalid recipient " + target)
-			}
+				}
 
-			dispatchContractEvent(call.ContractId, ctevent{call.Id, call.ContractId, call.Method, call.Msatoshi, fmt.Sprintf("contract.send(%s, %d)", target, msat), "function"}, "call-run-event")
-			return msat, nil
-		},
+				sch := data.Schedule{
+					Id:         data.ScheduleId(call.Id, len(schedules)),
+					ContractId: call.ContractId,
+					Method:     method,
+					Payload:    jpayload,
+					Time:       time.Unix(at, 0),
+					Call:       call.Id,
+				}
+				schedules = append(schedules, sch)
 
-		// get account balance
-		func() (userBalance int64, err error) {
-			if call.Caller == "" {
-				return 0, errors.New("no account")
-			}
-			return data.GetAccountBalance(call.Caller), nil
-		},
+				dispatchContractEvent(call.ContractId, ctevent{call.Id, call.ContractId, call.Method, call.Msatoshi, fmt.Sprintf("contract.schedule(%s, %d)", method, at), "function"}, "call-run-event")
+				return sch.Id, nil
+			},
+
+			GetRandomBytes: func(n int) (string, error) {
+				random, err := randomBytes(n)
+				if err != nil {
+					return "", err
+				}
+				call.Random = append(call.Random, random)
+				return random, nil
+			},
+
+			GetStorage: func(key string) (value interface{}, err error) {
+				jvalue, ok := storage[key]
+				if !ok {
+					jvalue, err = data.GetStorage(call.ContractId, key)
+					if err != nil {
+						return nil, err
+					}
+				}
+				if jvalue == nil {
+					return nil, nil
+				}
+				err = json.Unmarshal(jvalue, &value)
+				return value, err
+			},
+
+			SetStorage: func(key string, value interface{}) error {
+				jvalue, err := json.Marshal(value)
+				if err != nil {
+					return fmt.Errorf("can't encode value: %w", err)
+				}
+				storage[key] = jvalue
+				return nil
+			},
+
+			DeleteStorage: func(key string) error {
+				storage[key] = nil
+				return nil
+			},
+
+			ListStorageKeys: func(prefix string) ([]string, error) {
+				return listStorageKeys(call.ContractId, prefix, storage)
+			},
+
+			GetLibraryCode: getLibraryCode,
+			GetCurrentAccountBalance: func() (userBalance int64, err error) {
+				if call.Caller == "" {
+					return 0, errors.New("no account")
+				}
+				// with what the calls so far have taken or sent to it
+				if balance, ok := callContext.AccountBalances[call.Caller]; ok {
+					return balance, nil
+				}
+				return data.GetAccountBalance(call.Caller), nil
+			},
+
+			SendFromAccount: func(target string, msat int64) (msatoshiSent int64, err error) {
+				// only the account that has authorized the call, never the
+				// contracts calling other contracts
+				if call.Caller == "" || call.Caller[0] == 'c' {
+					return 0, errors.New("no account")
+				}
+				if len(target) == 0 {
+					return 0, errors.New("can't send to blank recipient")
+				}
+				if msat <= 0 {
+					return 0, errors.New("amount must be positive")
+				}
+
+				balance, ok := callContext.AccountBalances[call.Caller]
+				if !ok {
+					balance = data.GetAccountBalance(call.Caller)
+				}
+				if balance < msat {
+					return 0, errors.New("insufficient account balance")
+				}
+				callContext.AccountBalances[call.Caller] = balance - msat
+
+				if err := creditRecipient(callContext, target, msat); err != nil {
+					return 0, err
+				}
+				call.Transfers = append(call.Transfers, data.Transfer{
+					From:     call.Caller,
+					To:       target,
+					Msatoshi: msat,
+				})
+
+				dispatchContractEvent(call.ContractId, ctevent{call.Id, call.ContractId, call.Method, call.Msatoshi, fmt.Sprintf("account.send(%s, %d)", target, msat), "function"}, "call-run-event")
+				return msat, nil
+			},
+
+			HoldFunds: func(account string, msat int64, expiry int64) (id string, err error) {
+				// like account.send, only the account that has authorized the call
+				if call.Caller == "" || call.Caller[0] == 'c' || account != call.Caller {
+					return "", errors.New("can only hold funds from the account making the call")
+				}
+				if msat <= 0 {
+					return "", errors.New("amount must be positive")
+				}
+				if expiry <= call.Time.Unix() {
+					return "", errors.New("expiry must be in the future")
+				}
+
+				balance, ok := callContext.AccountBalances[account]
+				if !ok {
+					balance = data.GetAccountBalance(account)
+				}
+				if balance < msat {
+					return "", errors.New("insufficient account balance")
+				}
+				callContext.AccountBalances[account] = balance - msat
+
+				hold := &data.Hold{
+					Id:         data.HoldId(call.Id, nholds),
+					ContractId: call.ContractId,
+					Account:    account,
+					Msatoshi:   msat,
+					Expiry:     time.Unix(expiry, 0),
+					Call:       call.Id,
+				}
+				nholds++
+				callContext.Holds[hold.Id] = hold
+
+				dispatchContractEvent(call.ContractId, ctevent{call.Id, call.ContractId, call.Method, call.Msatoshi, fmt.Sprintf("contract.hold(%s, %d, %d)", account, msat, expiry), "function"}, "call-run-event")
+				return hold.Id, nil
+			},
+
+			CaptureHold: func(id string, msat int64) (msatoshiCaptured int64, err error) {
+				hold, err := getHold(call, callContext, id)
+				if err != nil {
+					return 0, err
+				}
+				if msat <= 0 || msat > hold.Msatoshi {
+					return 0, fmt.Errorf("amount must be between 1 and %d", hold.Msatoshi)
+				}
+
+				// the contract gets what was captured and the account the rest
+				callContext.Funds[call.ContractId] += msat
+				call.Transfers = append(call.Transfers, data.Transfer{
+					From:     hold.Account,
+					To:       call.ContractId,
+					Msatoshi: msat,
+				})
+				if remainder := hold.Msatoshi - msat; remainder > 0 {
+					if err := creditRecipient(callContext, hold.Account, remainder); err != nil {
+						return 0, err
+					}
+					call.Transfers = append(call.Transfers, data.Transfer{
+						From:     hold.Id,
+						To:       hold.Account,
+						Msatoshi: remainder,
+					})
+				}
+				hold.Msatoshi = 0
+
+				dispatchContractEvent(call.ContractId, ctevent{call.Id, call.ContractId, call.Method, call.Msatoshi, fmt.Sprintf("contract.capture(%s, %d)", id, msat), "function"}, "call-run-event")
+				return msat, nil
+			},
 
+			ReleaseHold: func(id string) error {
+				hold, err := getHold(call, callContext, id)
+				if err != nil {
+					return err
+				}
+
+				if err := creditRecipient(callContext, hold.Account, hold.Msatoshi); err != nil {
+					return err
+				}
+				call.Transfers = append(call.Transfers, data.Transfer{
+					From:     hold.Id,
+					To:       hold.Account,
+					Msatoshi: hold.Msatoshi,
+				})
+				hold.Msatoshi = 0
+
+				dispatchContractEvent(call.ContractId, ctevent{call.Id, call.ContractId, call.Method, call.Msatoshi, fmt.Sprintf("contract.release(%s)", id), "function"}, "call-run-event")
+				return nil
+			},
+		},
 		*ct,
 		*call,
 	)
@@ -314,16 +652,337 @@ func runCall(call *data.Call, callContext *CallContext, useBalance bool) (err er
 		return fmt.Errorf("error marshaling new state: %w", err)
 	}
 
+	// on __init__ and __migrate__ the returned value is the state, on others
+	// it's the call result
+	if call.Method != "__init__" && call.Method != "__migrate__" && returned != nil {
+		result, err := json.Marshal(returned)
+		if err != nil {
+			return fmt.Errorf("error marshaling call result: %w", err)
+		}
+		call.Result = result
+	}
+
 	// write call files
+	call.GasUsed = gasUsed
 	if err = data.SaveCall(call); err != nil {
 		return fmt.Errorf("error saving call data: %w", err)
 	}
+	if err := data.SaveTransfers(call, call.Transfers); err != nil {
+		return fmt.Errorf("error saving call transfers: %w", err)
+	}
 
 	if err := data.SaveContractState(call.ContractId, newState); err != nil {
 		return fmt.Errorf("error saving contract state: %w", err)
 	}
 
+	for key, value := range storage {
+		if value == nil {
+			err = data.DeleteStorage(call.ContractId, key)
+		} else {
+			err = data.SaveStorage(call.ContractId, key, value)
+		}
+		if err != nil {
+			return fmt.Errorf("error saving contract storage: %w", err)
+		}
+	}
+
+	for _, sch := range schedules {
+		if err := data.SaveSchedule(sch); err != nil {
+			return fmt.Errorf("error saving scheduled call: %w", err)
+		}
+	}
+	callContext.Schedules = append(callContext.Schedules, schedules...)
+
+	callContext.Calls = append(callContext.Calls, call)
+
 	// ok, all is good
 	log.Info().Str("callid", call.Id).Msg("call done")
 	return
 }
+
+// runQuery runs a contract method in read-only mode: the state changes are
+// discarded, funds can't be moved and the value returned by the method is
+// returned here. when it's queried by another contract it sees the changes
+// made so far by the calls in callContext.
+func runQuery(ctx context.Context, call *data.Call, callContext *CallContext) (result interface{}, gasUsed int64, err error) {
+	if callContext.Running[call.ContractId] {
+		return nil, 0, errors.New("can't query " + call.ContractId + ", it is already running")
+	}
+	if callContext.Depth >= s.CallMaxDepth {
+		return nil, 0, fmt.Errorf("maximum call depth of %d exceeded", s.CallMaxDepth)
+	}
+
+	ct, err := data.GetContract(call.ContractId)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to load contract %s: %w", call.ContractId, err)
+	}
+	if ct.Library {
+		return nil, 0, errors.New("can't call " + call.ContractId + ", it is a library")
+	}
+
+	callContext.Running[call.ContractId] = true
+	callContext.Depth++
+	defer func() {
+		delete(callContext.Running, call.ContractId)
+		callContext.Depth--
+	}()
+
+	funds, ok := callContext.Funds[call.ContractId]
+	if !ok {
+		funds = ct.Funds
+	}
+	storage := callContext.Storage[call.ContractId]
+
+	_, result, gasUsed, err = runlua.RunCall(
+		ctx,
+		log,
+		ioutil.Discard,
+		runlua.Callbacks{
+			MakeRequest:             makeContractRequest,
+			GetExternalContractData: getExternalContractData,
+			CallExternalMethod: func(_ string, _ string, _ interface{}, _ int64, _ int64) (interface{}, int64, error) {
+				return nil, 0, errors.New("can't call other contracts from a read-only query")
+			},
+
+			QueryExternalMethod: func(externalContractId string, method string, payload interface{}, gasLimit int64) (result interface{}, gasUsed int64, err error) {
+				jpayload, _ := json.Marshal(payload)
+				jresult, gasUsed, err := queryExternal(ctx, call, callContext, externalContractId, method, jpayload, gasLimit)
+				if err != nil {
+					return nil, 0, err
+				}
+				result, err = decodeResult(jresult)
+				return result, gasUsed, err
+			},
+
+			GetContractFunds: func() (contractFunds int64, err error) { return funds, nil },
+			SendFromContract: func(_ string, _ int64) (msatoshiSent int64, err error) {
+				return 0, errors.New("can't send funds from a read-only query")
+			},
+
+			// events from queries are just ignored
+			EmitEvent: func(_ string, _ interface{}) error { return nil },
+			ScheduleCall: func(_ string, _ interface{}, _ int64) (string, error) {
+				return "", errors.New("can't schedule calls from a read-only query")
+			},
+
+			GetRandomBytes: randomBytes,
+			GetStorage: func(key string) (value interface{}, err error) {
+				jvalue, ok := storage[key]
+				if !ok {
+					jvalue, err = data.GetStorage(call.ContractId, key)
+					if err != nil {
+						return nil, err
+					}
+				}
+				if jvalue == nil {
+					return nil, nil
+				}
+				err = json.Unmarshal(jvalue, &value)
+				return value, err
+			},
+
+			SetStorage: func(_ string, _ interface{}) error {
+				return errors.New("can't change storage from a read-only query")
+			},
+
+			DeleteStorage: func(_ string) error {
+				return errors.New("can't change storage from a read-only query")
+			},
+
+			ListStorageKeys: func(prefix string) ([]string, error) {
+				return listStorageKeys(call.ContractId, prefix, storage)
+			},
+
+			GetLibraryCode: getLibraryCode,
+			GetCurrentAccountBalance: func() (userBalance int64, err error) {
+				if call.Caller == "" {
+					return 0, errors.New("no account")
+				}
+				// with what the calls so far have taken or sent to it
+				if balance, ok := callContext.AccountBalances[call.Caller]; ok {
+					return balance, nil
+				}
+				return data.GetAccountBalance(call.Caller), nil
+			},
+
+			SendFromAccount: func(_ string, _ int64) (msatoshiSent int64, err error) {
+				return 0, errors.New("can't send funds from a read-only query")
+			},
+
+			HoldFunds: func(_ string, _ int64, _ int64) (string, error) {
+				return "", errors.New("can't hold funds from a read-only query")
+			},
+
+			CaptureHold: func(_ string, _ int64) (msatoshiCaptured int64, err error) {
+				return 0, errors.New("can't capture funds from a read-only query")
+			},
+
+			ReleaseHold: func(_ string) error {
+				return errors.New("can't release funds from a read-only query")
+			},
+		},
+		*ct,
+		*call,
+	)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error executing method: %w", err)
+	}
+
+	return result, gasUsed, nil
+}
+
+// queryExternal runs a read-only query on another contract on behalf of the
+// contract running call and returns the result as JSON.
+func queryExternal(
+	ctx context.Context,
+	call *data.Call,
+	callContext *CallContext,
+	externalContractId string,
+	method string,
+	jpayload json.RawMessage,
+	gasLimit int64,
+) (jresult json.RawMessage, gasUsed int64, err error) {
+	if len(method) == 0 || method[0] == '_' {
+		return nil, 0, errors.New("invalid method " + method)
+	}
+
+	var result interface{}
+	result, gasUsed, err = runQuery(ctx, &data.Call{
+		ContractId: externalContractId,
+		Id:         call.Id,
+		Method:     method,
+		Payload:    jpayload,
+		Caller:     call.ContractId,
+		GasLimit:   gasLimit,
+		Time:       call.Time,
+	}, callContext)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// the same thing the query API would return
+	jresult, err = json.Marshal(result)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error marshaling query result: %w", err)
+	}
+	return jresult, gasUsed, nil
+}
+
+// decodeResult turns a call result back into a value contracts can use.
+func decodeResult(jresult json.RawMessage) (result interface{}, err error) {
+	if len(jresult) == 0 {
+		return nil, nil
+	}
+	err = json.Unmarshal(jresult, &result)
+	return result, err
+}
+
+// creditRecipient adds msat to the funds of a contract or the balance of an
+// account, as they will be when the calls finish.
+func creditRecipient(callContext *CallContext, target string, msat int64) error {
+	if target[0] == 'c' {
+		// it's a contract
+		if current, ok := callContext.Funds[target]; ok {
+			callContext.Funds[target] = current + msat
+		} else {
+			targetContract, err := data.GetContract(target)
+			if err != nil {
+				return errors.New("contract " + target + " not found")
+			}
+			callContext.Funds[target] = targetContract.Funds + msat
+		}
+	} else if target[0] == '0' {
+		// it's an account
+		if current, ok := callContext.AccountBalances[target]; ok {
+			callContext.AccountBalances[target] = current + msat
+		} else {
+			current := data.GetAccountBalance(target)
+			callContext.AccountBalances[target] = current + msat
+		}
+	} else {
+		return errors.New("invalid recipient " + target)
+	}
+	return nil
+}
+
+// getHold returns a hold the contract running call can capture or release,
+// as it is in the current chain of calls.
+func getHold(call *data.Call, callContext *CallContext, id string) (*data.Hold, error) {
+	hold, ok := callContext.Holds[id]
+	if !ok {
+		var err error
+		hold, err = data.GetHold(id)
+		if err != nil {
+			return nil, err
+		}
+		callContext.Holds[id] = hold
+	}
+
+	if hold.ContractId != call.ContractId {
+		return nil, errors.New("hold " + id + " belongs to another contract")
+	}
+	if hold.Msatoshi == 0 {
+		return nil, errors.New("hold " + id + " was already captured or released")
+	}
+	if !call.Time.Before(hold.Expiry) {
+		return nil, errors.New("hold " + id + " has expired")
+	}
+	return hold, nil
+}
+
+func getExternalContractData(contractId string) (state interface{}, funds int64, err error) {
+	ct, err := data.GetContract(contractId)
+	if err != nil {
+		return
+	}
+	err = json.Unmarshal(ct.State, &state)
+	if err != nil {
+		return
+	}
+	return state, ct.Funds, nil
+}
+
+// randomBytes is the source of util.random_bytes, the only non-deterministic
+// thing available to contracts, which is why its output is saved in the call.
+func randomBytes(n int) (string, error) {
+	if n <= 0 || n > 1024 {
+		return "", errors.New("can only get between 1 and 1024 random bytes")
+	}
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// listStorageKeys lists the keys saved on the database with the changes made
+// during the current calls applied.
+func listStorageKeys(
+	contractId string,
+	prefix string,
+	changes map[string]json.RawMessage,
+) ([]string, error) {
+	saved, err := data.ListStorageKeys(contractId, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	exists := make(map[string]bool, len(saved))
+	for _, key := range saved {
+		exists[key] = true
+	}
+	for key, value := range changes {
+		if strings.HasPrefix(key, prefix) {
+			exists[key] = value != nil
+		}
+	}
+
+	keys := make([]string, 0, len(exists))
+	for key, ok := range exists {
+		if ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
@@ -2,27 +2,44 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/fiatjaf/etleneum/data"
 	"github.com/gorilla/mux"
 	"github.com/lucsky/cuid"
+	"github.com/tidwall/gjson"
 )
 
 func prepareCall(w http.ResponseWriter, r *http.Request) {
 	ctid := mux.Vars(r)["ctid"]
 	logger := log.With().Str("ctid", ctid).Logger()
 
-	call := &data.Call{}
-	err := json.NewDecoder(r.Body).Decode(call)
+	// everything else in a call is filled by us
+	var input struct {
+		Method   string          `json:"method"`
+		Payload  json.RawMessage `json:"payload"`
+		Msatoshi int64           `json:"msatoshi"`
+		GasLimit int64           `json:"gas_limit"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&input)
 	if err != nil {
 		log.Warn().Err(err).Msg("failed to parse call json")
 		jsonError(w, "failed to parse json", 400)
 		return
 	}
-	call.ContractId = ctid
-	call.Id = "r" + cuid.Slug()
+	call := &data.Call{
+		Id:         "r" + cuid.Slug(),
+		ContractId: ctid,
+		Method:     input.Method,
+		Payload:    input.Payload,
+		Msatoshi:   input.Msatoshi,
+		GasLimit:   input.GasLimit,
+	}
 	call.Cost = getCallCosts(*call, false)
 	logger = logger.With().Str("callid", call.Id).Str("method", call.Method).Logger()
 	var useBalance bool
@@ -62,6 +79,21 @@ func prepareCall(w http.ResponseWriter, r *http.Request) {
 		jsonError(w, "invalid method", 400)
 		return
 	}
+	if call.GasLimit > s.CallGasLimit {
+		logger.Warn().Int64("gas", call.GasLimit).Msg("gas limit too high")
+		jsonError(w, "gas_limit can't be bigger than "+strconv.FormatInt(s.CallGasLimit, 10), 400)
+		return
+	}
+	if method, err := checkCallPayload(call); err != nil {
+		logger.Warn().Err(err).Str("payload", string(call.Payload)).
+			Msg("invalid payload")
+		jsonError(w, err.Error(), 400)
+		return
+	} else if method != nil && call.Msatoshi < method.Price {
+		jsonError(w, fmt.Sprintf("%s requires at least %d msatoshi",
+			call.Method, method.Price), 400)
+		return
+	}
 
 	// if useBalance then we try to run the call already
 	// and pay with funds from account balance
@@ -69,7 +101,7 @@ func prepareCall(w http.ResponseWriter, r *http.Request) {
 		data.Start()
 		logger.Info().Interface("call", call).Msg("call being made with balance funds")
 
-		err = runCallGlobal(call, true)
+		err = runCallGlobal(r.Context(), call, true)
 		if err != nil {
 			logger.Warn().Err(err).Str("payload", string(call.Payload)).
 				Msg("failed to run call")
@@ -88,8 +120,14 @@ func prepareCall(w http.ResponseWriter, r *http.Request) {
 
 		// call was successful
 		dispatchContractEvent(call.ContractId,
-			ctevent{call.Id, call.ContractId, call.Method, call.Msatoshi, "", ""},
+			callmadeevent{
+				ctevent{call.Id, call.ContractId, call.Method, call.Msatoshi, "", ""},
+				call.Result,
+			},
 			"call-made")
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Result{Ok: true, Value: call})
 	} else {
 		// useBalance = false, so we just prepare the call and show an invoice
 		// make an invoice and save the prepared call
@@ -161,6 +199,125 @@ func getCall(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(Result{Ok: true, Value: call})
 }
 
+// returns the call with all the calls it has made to other contracts
+func getCallTree(w http.ResponseWriter, r *http.Request) {
+	ctid := mux.Vars(r)["ctid"]
+	callid := mux.Vars(r)["callid"]
+
+	tree, err := data.GetCallTree(ctid, callid)
+	if err != nil {
+		log.Warn().Err(err).Str("callid", callid).Msg("database error fetching call tree")
+		jsonError(w, "database error", 500)
+		return
+	}
+	if tree == nil {
+		jsonError(w, "call not found", 404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Result{Ok: true, Value: tree})
+}
+
+// runs a method without payment and without persisting anything.
+// queries don't take the database lock, so they can see the changes of a call
+// that is running and that may still be reverted by data.Abort().
+// querySlots limits how many queries run at the same time, as they don't wait
+// for the data lock like calls do.
+var querySlots chan struct{}
+
+func queryContract(w http.ResponseWriter, r *http.Request) {
+	ctid := mux.Vars(r)["ctid"]
+	method := mux.Vars(r)["method"]
+	logger := log.With().Str("ctid", ctid).Str("method", method).Logger()
+
+	if rateLimited("query", r, s.QueryRateLimit) {
+		jsonError(w, "too many queries, try again later", 429)
+		return
+	}
+
+	// verify call is valid as best as possible
+	if len(method) == 0 || method[0] == '_' {
+		logger.Warn().Msg("invalid method")
+		jsonError(w, "invalid method", 400)
+		return
+	}
+
+	call := &data.Call{
+		Id:         "q" + cuid.Slug(),
+		ContractId: ctid,
+		Method:     method,
+		GasLimit:   s.QueryGasLimit,
+	}
+
+	qs := r.URL.Query()
+	if r.Method == "POST" {
+		// payload comes as the JSON body
+		defer r.Body.Close()
+		b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+		if err != nil {
+			jsonError(w, "payload too big", 413)
+			return
+		}
+		if strings.TrimSpace(string(b)) == "" {
+			b = []byte("{}")
+		}
+		if !gjson.ValidBytes(b) {
+			jsonError(w, "failed to parse json", 400)
+			return
+		}
+		call.Payload = b
+	} else {
+		// payload comes as query parameters
+		payload := make(map[string]interface{})
+		for k := range qs {
+			if strings.HasPrefix(k, "_") || k == "session" {
+				continue
+			}
+
+			v := qs.Get(k)
+			if gjson.Valid(v) {
+				payload[k] = gjson.Parse(v).Value()
+			} else {
+				payload[k] = v
+			}
+		}
+		call.Payload, _ = json.Marshal(payload)
+	}
+
+	if session := qs.Get("session"); session != "" {
+		accountId := rds.Get("auth-session:" + session).Val()
+		if accountId == "" {
+			logger.Warn().Str("session", session).
+				Msg("failed to get account for authenticated session")
+			jsonError(w, "failed to get account for authenticated session", 400)
+			return
+		}
+		call.Caller = accountId
+	}
+
+	select {
+	case querySlots <- struct{}{}:
+		defer func() { <-querySlots }()
+	case <-time.After(5 * time.Second):
+		jsonError(w, "too many queries running, try again later", 503)
+		return
+	case <-r.Context().Done():
+		return
+	}
+
+	result, _, err := runQuery(r.Context(), call, newCallContext())
+	if err != nil {
+		logger.Warn().Err(err).Str("payload", string(call.Payload)).
+			Msg("failed to run query")
+		jsonError(w, err.Error(), 400)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Result{Ok: true, Value: result})
+}
+
 // changes call payload after being prepared
 func patchCall(w http.ResponseWriter, r *http.Request) {
 	callid := mux.Vars(r)["callid"]
@@ -173,14 +330,13 @@ func patchCall(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// authenticated calls can only be modified by an authenticated session
+	// authenticated calls can only be modified by their author's session
 	if call.Caller != "" {
-		if session := r.URL.Query().Get("session"); session != "" {
-			accountId, err := rds.Get("auth-session:" + session).Result()
-			if err != nil || accountId != call.Caller {
-				jsonError(w, "only the author can patch an authenticated call.", 401)
-				return
-			}
+		session := r.URL.Query().Get("session")
+		accountId, err := rds.Get("auth-session:" + session).Result()
+		if session == "" || err != nil || accountId != call.Caller {
+			jsonError(w, "only the author can patch an authenticated call.", 401)
+			return
 		}
 	}
 
@@ -200,6 +356,14 @@ func patchCall(w http.ResponseWriter, r *http.Request) {
 	jpayload, _ := json.Marshal(payload)
 	call.Payload.UnmarshalJSON(jpayload)
 
+	// the patched payload must still match the method annotations
+	if _, err := checkCallPayload(call); err != nil {
+		logger.Warn().Err(err).Str("payload", string(call.Payload)).
+			Msg("invalid patched payload")
+		jsonError(w, err.Error(), 400)
+		return
+	}
+
 	_, err = saveCallOnRedis(*call)
 	if err != nil {
 		logger.Error().Err(err).Interface("call", call).
@@ -13,6 +13,7 @@ function getInitial() {
     id: null,
     balance: 0,
     can_withdraw: 0,
+    reserved: 0,
     secret: '',
   }
 }
@@ -64,6 +65,7 @@ function startEventSource() {
       id: data.account,
       balance: data.balance,
       can_withdraw: data.can_withdraw,
+      reserved: data.reserved || 0,
       secret: data.secret
     }
     storeSet(current)
@@ -88,8 +90,8 @@ function startEventSource() {
 
 export default account
 
-export function hmacCall(contractId, call) {
-  var res = `${contractId}:${call.method}:${call.msatoshi},`
+export function hmacCall(contractId, call, nonce, expiry) {
+  var res = `${contractId}:${call.method}:${call.msatoshi}:${nonce}:${expiry},`
 
   var keys = Object.keys(call.payload).sort()
   for (let i = 0; i < keys.length; i++) {
@@ -2,7 +2,8 @@ package main
 
 import (
 	"encoding/json"
-	"strings"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/aarzilli/golua/lua"
@@ -26,20 +27,57 @@ func contractFromRedis(ctid string) (ct *data.Contract, err error) {
 	return
 }
 
-func checkContractCode(code string) (ok bool) {
-	if strings.Index(code, "function __init__") == -1 {
-		return false
+func checkContractCode(code string, library bool) error {
+	if err := data.CheckContractCode(code, library); err != nil {
+		return err
 	}
 
+	// our parser is not the real one, so also check with lua
 	L := lua.NewState()
 	defer L.Close()
 
 	lerr := L.LoadString(code)
 	if lerr != 0 {
-		return false
+		return errors.New(L.ToString(-1))
 	}
 
-	return true
+	return nil
+}
+
+// pinLibraries finds the libraries required by the contract code and returns
+// the hash of each, so the contract always runs with the code it was created
+// with.
+func pinLibraries(code string) (map[string]string, error) {
+	ids := data.RequiredLibraries(code)
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	pins := make(map[string]string, len(ids))
+	for _, id := range ids {
+		lib, _ := data.GetContract(id)
+		if lib == nil {
+			return nil, fmt.Errorf("library %s not found", id)
+		}
+		if !lib.Library {
+			return nil, fmt.Errorf("contract %s is not a library", id)
+		}
+		pins[id] = data.CodeHash(lib.Code)
+	}
+	return pins, nil
+}
+
+// getLibraryCode is what contracts call on require(), it only returns the
+// code if it's the same that was pinned.
+func getLibraryCode(id string, hash string) (code string, libraries map[string]string, err error) {
+	lib, _ := data.GetContract(id)
+	if lib == nil || !lib.Library {
+		return "", nil, errors.New("library " + id + " not found")
+	}
+	if data.CodeHash(lib.Code) != hash {
+		return "", nil, errors.New("library " + id + " doesn't match the pinned version")
+	}
+	return lib.Code, lib.Libraries, nil
 }
 
 func getContractCost(ct data.Contract) int64 {
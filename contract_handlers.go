@@ -1,14 +1,17 @@
 package main
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/fiatjaf/etleneum/data"
+	"github.com/fiatjaf/etleneum/runlua"
 	"github.com/gorilla/mux"
 	"github.com/lucsky/cuid"
 )
@@ -42,13 +45,38 @@ func prepareContract(w http.ResponseWriter, r *http.Request) {
 	}
 
 	ct.Id = "c" + cuid.Slug()
+	ct.Owner = ""
+	ct.Version = 0
 
-	if ok := checkContractCode(ct.Code); !ok {
+	// contracts created with an authenticated session can be upgraded by
+	// that account later
+	if session := r.URL.Query().Get("session"); session != "" {
+		ct.Owner = rds.Get("auth-session:" + session).Val()
+		if ct.Owner == "" {
+			log.Warn().Str("session", session).
+				Msg("failed to get account for authenticated session")
+			jsonError(w, "failed to get account for authenticated session", 400)
+			return
+		}
+	}
+
+	if err := checkContractCode(ct.Code, ct.Library); err != nil {
 		log.Warn().Err(err).Msg("invalid contract code")
-		jsonError(w, "invalid contract code", 400)
+		jsonError(w, "invalid contract code: "+err.Error(), 400)
 		return
 	}
 
+	ct.Libraries, err = pinLibraries(ct.Code)
+	if err != nil {
+		log.Warn().Err(err).Msg("invalid library")
+		jsonError(w, err.Error(), 400)
+		return
+	}
+
+	// these don't stop the contract from being created, they're just shown
+	// to the creator before paying
+	warnings, _ := runlua.Lint(ct.Code)
+
 	invoice, err := makeInvoice(
 		s.FreeMode,
 		ct.Id,
@@ -79,8 +107,9 @@ func prepareContract(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(Result{Ok: true, Value: map[string]interface{}{
-		"id":      ct.Id,
-		"invoice": invoice,
+		"id":       ct.Id,
+		"invoice":  invoice,
+		"warnings": warnings,
 	}})
 }
 
@@ -162,6 +191,296 @@ func getContractFunds(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(Result{Ok: true, Value: ct.Funds})
 }
 
+func getContractEvents(w http.ResponseWriter, r *http.Request) {
+	ctid := mux.Vars(r)["ctid"]
+	qs := r.URL.Query()
+
+	ct, _ := data.GetContract(ctid)
+	if ct == nil {
+		jsonError(w, "contract not found", 404)
+		return
+	}
+
+	limit, _ := strconv.Atoi(qs.Get("limit"))
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+	offset, _ := strconv.Atoi(qs.Get("offset"))
+	if offset < 0 {
+		offset = 0
+	}
+
+	events, err := data.ListContractEvents(ctid, qs.Get("name"), limit, offset)
+	if err != nil {
+		log.Warn().Err(err).Str("ctid", ctid).Msg("failed to list events")
+		jsonError(w, "failed to list events", 500)
+		return
+	}
+	if events == nil {
+		events = make([]data.Event, 0)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Result{Ok: true, Value: events})
+}
+
+func getContractSchedules(w http.ResponseWriter, r *http.Request) {
+	ctid := mux.Vars(r)["ctid"]
+
+	schedules, err := data.ListSchedules(ctid)
+	if err != nil {
+		log.Warn().Err(err).Str("ctid", ctid).Msg("failed to list schedules")
+		jsonError(w, "failed to list scheduled calls", 500)
+		return
+	}
+	if schedules == nil {
+		schedules = make([]data.Schedule, 0)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Result{Ok: true, Value: schedules})
+}
+
+func getContractStorageKeys(w http.ResponseWriter, r *http.Request) {
+	ctid := mux.Vars(r)["ctid"]
+
+	ct, _ := data.GetContract(ctid)
+	if ct == nil {
+		jsonError(w, "contract not found", 404)
+		return
+	}
+
+	keys, err := data.ListStorageKeys(ctid, r.URL.Query().Get("prefix"))
+	if err != nil {
+		log.Warn().Err(err).Str("ctid", ctid).Msg("failed to list storage keys")
+		jsonError(w, "failed to list storage keys", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Result{Ok: true, Value: keys})
+}
+
+func getContractStorageValue(w http.ResponseWriter, r *http.Request) {
+	ctid := mux.Vars(r)["ctid"]
+	key := mux.Vars(r)["key"]
+
+	value, err := data.GetStorage(ctid, key)
+	if err != nil {
+		log.Warn().Err(err).Str("ctid", ctid).Str("key", key).
+			Msg("failed to read storage key")
+		jsonError(w, "failed to read storage key", 500)
+		return
+	}
+	if value == nil {
+		jsonError(w, "key not found", 404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Result{Ok: true, Value: value})
+}
+
+func getContractVersions(w http.ResponseWriter, r *http.Request) {
+	ctid := mux.Vars(r)["ctid"]
+
+	ct, _ := data.GetContract(ctid)
+	if ct == nil {
+		jsonError(w, "contract not found", 404)
+		return
+	}
+
+	versions, err := data.ListVersions(ctid)
+	if err != nil {
+		log.Warn().Err(err).Str("ctid", ctid).Msg("failed to list versions")
+		jsonError(w, "failed to list versions", 500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Result{Ok: true, Value: versions})
+}
+
+func getContractVersion(w http.ResponseWriter, r *http.Request) {
+	ctid := mux.Vars(r)["ctid"]
+	version, _ := strconv.Atoi(mux.Vars(r)["version"])
+
+	v, err := data.GetVersion(ctid, version)
+	if err != nil {
+		log.Warn().Err(err).Str("ctid", ctid).Int("version", version).
+			Msg("failed to read version")
+		jsonError(w, "failed to read version", 500)
+		return
+	}
+	if v == nil {
+		jsonError(w, "version not found", 404)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Result{Ok: true, Value: v})
+}
+
+// replaces the contract code and runs __migrate__, paid with the owner balance
+func upgradeContract(w http.ResponseWriter, r *http.Request) {
+	ctid := mux.Vars(r)["ctid"]
+	logger := log.With().Str("ctid", ctid).Logger()
+
+	session := r.URL.Query().Get("session")
+	accountId := rds.Get("auth-session:" + session).Val()
+	if session == "" || accountId == "" {
+		jsonError(w, "an authenticated session is required to upgrade", 401)
+		return
+	}
+
+	ct, _ := data.GetContract(ctid)
+	if ct == nil {
+		jsonError(w, "contract not found", 404)
+		return
+	}
+	if ct.Owner == "" || ct.Owner != accountId {
+		jsonError(w, "only the contract owner can upgrade it", 401)
+		return
+	}
+	if ct.Library {
+		jsonError(w, "libraries can't be upgraded, create a new one", 400)
+		return
+	}
+
+	upgrade := &data.Contract{}
+	err := json.NewDecoder(r.Body).Decode(upgrade)
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to parse upgrade json")
+		jsonError(w, "failed to parse json", 400)
+		return
+	}
+
+	if err := checkContractCode(upgrade.Code, false); err != nil {
+		logger.Warn().Err(err).Msg("invalid contract code")
+		jsonError(w, "invalid contract code: "+err.Error(), 400)
+		return
+	}
+
+	libraries, err := pinLibraries(upgrade.Code)
+	if err != nil {
+		logger.Warn().Err(err).Msg("invalid library")
+		jsonError(w, err.Error(), 400)
+		return
+	}
+
+	call := &data.Call{
+		ContractId: ctid,
+		Id:         "m" + cuid.Slug(),
+		Method:     "__migrate__",
+		Payload:    []byte("{}"),
+		Cost:       getContractCost(*upgrade),
+		Caller:     accountId,
+	}
+	logger = logger.With().Str("callid", call.Id).Logger()
+
+	data.Start()
+
+	// it may have been transferred since we've checked
+	if data.GetContractOwner(ctid) != accountId {
+		data.Unlock()
+		jsonError(w, "only the contract owner can upgrade it", 401)
+		return
+	}
+
+	version, err := data.UpgradeContract(ctid, upgrade.Code, libraries, call.Id)
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to save upgraded contract")
+		data.Abort()
+		jsonError(w, "failed to save upgraded contract", 500)
+		return
+	}
+
+	err = runCallGlobal(r.Context(), call, true)
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to run migration")
+		data.Abort()
+		jsonError(w, "failed to run migration: "+err.Error(), 400)
+		dispatchContractEvent(call.ContractId,
+			ctevent{
+				call.Id, call.ContractId, call.Method, call.Msatoshi,
+				err.Error(), "runtime",
+			}, "call-error")
+		return
+	}
+
+	data.Finish("contract " + ctid + " upgraded to version " + strconv.Itoa(version) + ".")
+	logger.Info().Int("version", version).Msg("contract upgraded")
+
+	dispatchContractEvent(call.ContractId,
+		callmadeevent{
+			ctevent{call.Id, call.ContractId, call.Method, call.Msatoshi, "", ""},
+			call.Result,
+		},
+		"call-made")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Result{Ok: true, Value: call})
+}
+
+// gives the contract to another account
+func transferContractOwnership(w http.ResponseWriter, r *http.Request) {
+	ctid := mux.Vars(r)["ctid"]
+	logger := log.With().Str("ctid", ctid).Logger()
+
+	session := r.URL.Query().Get("session")
+	accountId := rds.Get("auth-session:" + session).Val()
+	if session == "" || accountId == "" {
+		jsonError(w, "an authenticated session is required to transfer a contract", 401)
+		return
+	}
+
+	ct, _ := data.GetContract(ctid)
+	if ct == nil {
+		jsonError(w, "contract not found", 404)
+		return
+	}
+	if ct.Owner == "" || ct.Owner != accountId {
+		jsonError(w, "only the contract owner can transfer it", 401)
+		return
+	}
+
+	var params struct {
+		Owner string `json:"owner"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to parse transfer json")
+		jsonError(w, "failed to parse json", 400)
+		return
+	}
+
+	// accounts are the public keys used on lnurl-auth
+	if key, err := hex.DecodeString(params.Owner); err != nil || len(key) != 33 {
+		jsonError(w, "invalid account "+params.Owner, 400)
+		return
+	}
+
+	data.Start()
+	if data.GetContractOwner(ctid) != accountId {
+		data.Unlock()
+		jsonError(w, "only the contract owner can transfer it", 401)
+		return
+	}
+	if err := data.SaveContractOwner(ctid, params.Owner); err != nil {
+		logger.Warn().Err(err).Msg("failed to save contract owner")
+		data.Abort()
+		jsonError(w, "failed to save contract owner", 500)
+		return
+	}
+	data.Finish("contract " + ctid + " transferred from " + ct.Owner + " to " + params.Owner + ".")
+	logger.Info().Str("from", ct.Owner).Str("to", params.Owner).
+		Msg("contract ownership transferred")
+
+	ct.Owner = params.Owner
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Result{Ok: true, Value: ct})
+}
+
 func deleteContract(w http.ResponseWriter, r *http.Request) {
 	ctid := mux.Vars(r)["ctid"]
 
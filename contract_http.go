@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fiatjaf/etleneum/data"
+	"github.com/fiatjaf/etleneum/runlua"
+)
+
+// these are never reachable from contracts unless explicitly allowed with an
+// ip or cidr in CONTRACT_HTTP_ALLOW.
+var blockedNetworks = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",   // nat64, embeds any ipv4 address
+	"64:ff9b:1::/48", // local-use nat64
+	"2002::/16",      // 6to4, same
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+// hostPolicy is a list of hostnames (which also match their subdomains) and
+// ip networks, as given in CONTRACT_HTTP_ALLOW and CONTRACT_HTTP_DENY.
+type hostPolicy struct {
+	domains  []string
+	networks []*net.IPNet
+}
+
+func parseHostPolicy(entries []string) (hp hostPolicy) {
+	for _, entry := range entries {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+
+		if _, ipnet, err := net.ParseCIDR(entry); err == nil {
+			hp.networks = append(hp.networks, ipnet)
+		} else if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * len(ip)
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			hp.networks = append(hp.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		} else {
+			hp.domains = append(hp.domains, strings.TrimPrefix(entry, "."))
+		}
+	}
+	return hp
+}
+
+func (hp hostPolicy) empty() bool {
+	return len(hp.domains) == 0 && len(hp.networks) == 0
+}
+
+func (hp hostPolicy) matchesHost(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if ip := net.ParseIP(host); ip != nil {
+		return hp.matchesIP(ip)
+	}
+
+	for _, domain := range hp.domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (hp hostPolicy) matchesIP(ip net.IP) bool {
+	for _, ipnet := range hp.networks {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	contractHTTPAllow  hostPolicy
+	contractHTTPDeny   hostPolicy
+	contractHTTPClient *http.Client
+)
+
+func setupContractHTTP() {
+	contractHTTPAllow = parseHostPolicy(s.ContractHTTPAllow)
+	contractHTTPDeny = parseHostPolicy(s.ContractHTTPDeny)
+
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: contractHTTPDialControl,
+	}
+
+	contractHTTPClient = &http.Client{
+		Timeout: time.Second * 5,
+		Transport: &http.Transport{
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			MaxIdleConns:        10,
+			MaxConnsPerHost:     10,
+			MaxIdleConnsPerHost: 2,
+			IdleConnTimeout:     10 * time.Second,
+			DisableCompression:  true,
+		},
+		CheckRedirect: func(r *http.Request, via []*http.Request) error {
+			return fmt.Errorf("target '%s' has returned a redirect", r.URL)
+		},
+	}
+}
+
+// contractHTTPDialControl runs after DNS resolution, so it catches hostnames
+// pointing to internal addresses too.
+func contractHTTPDialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("invalid address %s", address)
+	}
+	return checkContractHTTPAddress(ip)
+}
+
+func checkContractHTTPAddress(ip net.IP) error {
+	if contractHTTPDeny.matchesIP(ip) {
+		return fmt.Errorf("address %s is blocked", ip)
+	}
+
+	for _, ipnet := range blockedNetworks {
+		if ipnet.Contains(ip) && !contractHTTPAllow.matchesIP(ip) {
+			return fmt.Errorf("address %s is not publicly routable", ip)
+		}
+	}
+
+	return nil
+}
+
+// makeContractRequest is what contracts use for all their http calls.
+func makeContractRequest(r *http.Request) (*http.Response, error) {
+	if r.URL.Scheme != "http" && r.URL.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme '%s'", r.URL.Scheme)
+	}
+
+	host := r.URL.Hostname()
+	if host == "" {
+		return nil, errors.New("missing host")
+	}
+	if contractHTTPDeny.matchesHost(host) {
+		return nil, fmt.Errorf("host %s is blocked", host)
+	}
+	if !contractHTTPAllow.empty() && !contractHTTPAllow.matchesHost(host) {
+		return nil, fmt.Errorf("host %s is not allowed", host)
+	}
+
+	return contractHTTPClient.Do(r)
+}
+
+// recordRequests wraps makeContractRequest so every request made during a
+// call is stored in it, allowing anyone to check later why the call had the
+// outcome it had.
+func recordRequests(call *data.Call) func(*http.Request) (*http.Response, error) {
+	limit := int(s.RecordedHTTPBodyKB << 10)
+	truncate := func(b []byte) (string, bool) {
+		if len(b) > limit {
+			return string(b[:limit]), true
+		}
+		return string(b), false
+	}
+
+	return func(r *http.Request) (*http.Response, error) {
+		record := data.HTTPRequest{
+			Method: r.Method,
+			URL:    r.URL.String(),
+		}
+
+		if r.Body != nil {
+			reqbody, err := ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(reqbody))
+			record.RequestBody, _ = truncate(reqbody)
+		}
+
+		resp, err := makeContractRequest(r)
+		if err != nil {
+			record.Error = err.Error()
+			call.HTTP = append(call.HTTP, record)
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		// the contract will never read more than this anyway
+		body, err := ioutil.ReadAll(
+			io.LimitReader(resp.Body, runlua.MaxHTTPResponseSize+1))
+		if err != nil {
+			record.Error = err.Error()
+			call.HTTP = append(call.HTTP, record)
+			return nil, err
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.Sum256(body)
+		record.Status = resp.StatusCode
+		record.BodyHash = hex.EncodeToString(hash[:])
+		record.Body, record.BodyTruncated = truncate(body)
+		call.HTTP = append(call.HTTP, record)
+
+		return resp, nil
+	}
+}
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = ipnet
+	}
+	return networks
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestContractHTTPDialControl(t *testing.T) {
+	defer func(allow, deny hostPolicy) {
+		contractHTTPAllow, contractHTTPDeny = allow, deny
+	}(contractHTTPAllow, contractHTTPDeny)
+	contractHTTPAllow = parseHostPolicy([]string{"10.1.2.3", "fd00:1::/32"})
+	contractHTTPDeny = parseHostPolicy([]string{"93.184.216.0/24"})
+
+	for _, tc := range []struct {
+		address string
+		allowed bool
+	}{
+		{"1.1.1.1:443", true},
+		{"[2606:4700:4700::1111]:443", true},
+		{"0.0.0.0:80", false},
+		{"127.0.0.1:80", false},
+		{"10.0.0.1:80", false},
+		{"172.16.5.4:80", false},
+		{"192.168.1.1:80", false},
+		{"169.254.169.254:80", false},
+		{"100.64.0.1:80", false},
+		{"[::]:80", false},
+		{"[::1]:80", false},
+		{"[fe80::1]:80", false},
+		{"[fc00::1]:80", false},
+		{"[::ffff:127.0.0.1]:80", false},
+		{"[::ffff:10.0.0.1]:80", false},
+		{"[64:ff9b::a00:1]:80", false},
+		{"[64:ff9b::7f00:1]:80", false},
+		{"[64:ff9b:1::a00:1]:80", false},
+		{"[2002:a00:1::1]:80", false},
+		{"[2002:c0a8:101::1]:80", false},
+
+		// explicitly allowed
+		{"10.1.2.3:80", true},
+		{"10.1.2.4:80", false},
+		{"[fd00:1::1]:80", true},
+		{"[fd00:2::1]:80", false},
+
+		// explicitly denied
+		{"93.184.216.34:443", false},
+
+		// not an address
+		{"localhost:80", false},
+		{"1.1.1.1", false},
+	} {
+		err := contractHTTPDialControl("tcp", tc.address, nil)
+		if tc.allowed && err != nil {
+			t.Errorf("%s should be allowed, got %s", tc.address, err)
+		} else if !tc.allowed && err == nil {
+			t.Errorf("%s should be blocked", tc.address)
+		}
+	}
+}
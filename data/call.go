@@ -20,6 +20,52 @@ type Call struct {
 	Msatoshi   int64           `json:"msatoshi"`       // msats to be added to the contract
 	Cost       int64           `json:"cost,omitempty"` // msats to be paid to the platform
 	Caller     string          `json:"caller"`
+	GasLimit   int64           `json:"gas_limit,omitempty"` // max gas the call is allowed to use
+	GasUsed    int64           `json:"gas_used,omitempty"`
+	Result     json.RawMessage `json:"result,omitempty"` // value returned by the method
+	Events     []Event         `json:"events,omitempty"`
+	HTTP       []HTTPRequest   `json:"http,omitempty"`    // requests made by the contract
+	Random     []string        `json:"random,omitempty"`  // hex bytes from util.random_bytes
+	Queries    []Query         `json:"queries,omitempty"` // made to other contracts
+	Transfers  []Transfer      `json:"transfers,omitempty"`
+	Parent     *CallRef        `json:"parent,omitempty"`  // the call that has made this one
+	Calls      []CallRef       `json:"calls,omitempty"`   // calls this one has made
+	Version    int             `json:"version,omitempty"` // of the contract code it ran on
+}
+
+// HTTPRequest is a request made by a contract during a call and the response
+// it got. Bodies may be truncated, but the hashes are always of the full body.
+type HTTPRequest struct {
+	Method        string `json:"method"`
+	URL           string `json:"url"`
+	RequestBody   string `json:"request_body,omitempty"`
+	Status        int    `json:"status,omitempty"`
+	BodyHash      string `json:"body_hash,omitempty"` // sha256, hex
+	Body          string `json:"body,omitempty"`
+	BodyTruncated bool   `json:"body_truncated,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+// CallRef points to a call on some contract.
+type CallRef struct {
+	ContractId string `json:"contract_id"`
+	Id         string `json:"id"`
+}
+
+// SubCallId is the id of the nth call made to another contract during a call.
+// It is derived from the call id so replaying the call gives the same ids.
+func SubCallId(call string, n int) string {
+	return fmt.Sprintf("%s-%d", call, n)
+}
+
+// Query is a read-only call made by a contract to another one during a call and
+// the result it got.
+type Query struct {
+	ContractId string          `json:"contract_id"`
+	Method     string          `json:"method"`
+	Payload    json.RawMessage `json:"payload"`
+	Result     json.RawMessage `json:"result,omitempty"`
+	GasUsed    int64           `json:"gas_used,omitempty"`
 }
 
 type Transfer struct {
@@ -33,34 +79,114 @@ func GetCall(contract string, id string) (call *Call, err error) {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		return nil, nil
 	}
+
+	call, err = readCall(contract, id, func(name string) ([]byte, error) {
+		return ioutil.ReadFile(filepath.Join(path, name))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// calls made before we started saving the time have just the commit time
+	if call.Time.IsZero() {
+		call.Time = gitGetLastCommitFileTimestamp(filepath.Join(path, "method.txt"))
+	}
+
+	return call, nil
+}
+
+// CallTree is a call with all the calls it has made to other contracts, and
+// the ones they have made, and so on.
+type CallTree struct {
+	Call
+	Calls []*CallTree `json:"calls"`
+}
+
+func GetCallTree(contract string, id string) (tree *CallTree, err error) {
+	call, err := GetCall(contract, id)
+	if err != nil || call == nil {
+		return nil, err
+	}
+
+	tree = &CallTree{Call: *call, Calls: make([]*CallTree, 0, len(call.Calls))}
+	for _, ref := range call.Calls {
+		sub, err := GetCallTree(ref.ContractId, ref.Id)
+		if err != nil {
+			return nil, err
+		}
+		if sub != nil {
+			tree.Calls = append(tree.Calls, sub)
+		}
+	}
+
+	return tree, nil
+}
+
+// readCall reads the files of a call with the given function, which can read
+// them from the current tree or from any point in the git history.
+func readCall(
+	contract string,
+	id string,
+	readFile func(name string) ([]byte, error),
+) (call *Call, err error) {
 	call = &Call{}
+	readJSON := func(name string, out interface{}) error {
+		b, err := readFile(name)
+		if err != nil {
+			return fmt.Errorf("error reading json file %s: %w", name, err)
+		}
+		return json.Unmarshal(b, out)
+	}
 
-	if err := readJSON(filepath.Join(path, "payload.json"), &call.Payload); err != nil {
+	if err := readJSON("payload.json", &call.Payload); err != nil {
 		return nil, err
 	}
 
-	if callerb, err := ioutil.ReadFile(filepath.Join(path, "caller.txt")); err == nil {
+	if callerb, err := readFile("caller.txt"); err == nil {
 		call.Caller = string(callerb)
 	}
 
-	if methodb, err := ioutil.ReadFile(filepath.Join(path, "method.txt")); err != nil {
+	if methodb, err := readFile("method.txt"); err != nil {
 		return nil, err
 	} else {
 		call.Method = string(methodb)
 	}
 
-	if csv, err := ioutil.ReadFile(filepath.Join(path, "transfers.csv")); err == nil {
-		for _, line := range strings.Split(string(csv), "\n") {
-			spl := strings.Split(line, ",")
-			if spl[2] == contract {
-				cost, _ := strconv.ParseInt(spl[1], 10, 64)
-				call.Msatoshi += cost
+	if csv, err := readFile("transfers.csv"); err == nil {
+		call.Transfers = ParseTransfers(csv)
+		for _, transfer := range call.Transfers {
+			// the call msatoshi is recorded before the call runs, anything
+			// sent to the contract after that (by account.send or by other
+			// contracts, or captured from holds) is not part of it
+			if transfer.From == contract {
+				// a call the contract has scheduled and paid for itself,
+				// it has no msatoshi
+				break
+			}
+			if transfer.To == contract &&
+				(transfer.From == "" || transfer.From[0] != 'c') {
+				call.Msatoshi = transfer.Msatoshi
+				break
 			}
 		}
 	}
 
-	call.Time = gitGetLastCommitFileTimestamp(filepath.Join(path, "method.txt"))
-	call.Id = filepath.Base(path)
+	readJSON("gas.json", &call.GasUsed)
+	readJSON("result.json", &call.Result)
+	readJSON("events.json", &call.Events)
+	readJSON("http.json", &call.HTTP)
+	readJSON("random.json", &call.Random)
+	readJSON("queries.json", &call.Queries)
+	readJSON("parent.json", &call.Parent)
+	readJSON("calls.json", &call.Calls)
+	readJSON("version.json", &call.Version)
+
+	var timestamp int64
+	if err := readJSON("time.json", &timestamp); err == nil {
+		call.Time = time.Unix(timestamp, 0)
+	}
+
+	call.Id = id
 	call.ContractId = contract
 
 	return call, nil
@@ -86,6 +212,11 @@ func SaveCall(call *Call) error {
 	); err != nil {
 		return err
 	}
+	if !call.Time.IsZero() {
+		if err := writeJSON(filepath.Join(path, "time.json"), call.Time.Unix()); err != nil {
+			return err
+		}
+	}
 	if call.Caller != "" {
 		if err := writeFile(
 			filepath.Join(path, "caller.txt"),
@@ -94,22 +225,91 @@ func SaveCall(call *Call) error {
 			return err
 		}
 	}
+	if call.GasUsed > 0 {
+		if err := writeJSON(filepath.Join(path, "gas.json"), call.GasUsed); err != nil {
+			return err
+		}
+	}
+	if len(call.Result) > 0 {
+		if err := writeJSON(filepath.Join(path, "result.json"), call.Result); err != nil {
+			return err
+		}
+	}
+	if len(call.Events) > 0 {
+		if err := writeJSON(filepath.Join(path, "events.json"), call.Events); err != nil {
+			return err
+		}
+		if err := saveEventsIndex(call); err != nil {
+			return err
+		}
+	}
+	if len(call.HTTP) > 0 {
+		if err := writeJSON(filepath.Join(path, "http.json"), call.HTTP); err != nil {
+			return err
+		}
+	}
+	if len(call.Random) > 0 {
+		if err := writeJSON(filepath.Join(path, "random.json"), call.Random); err != nil {
+			return err
+		}
+	}
+	if len(call.Queries) > 0 {
+		if err := writeJSON(filepath.Join(path, "queries.json"), call.Queries); err != nil {
+			return err
+		}
+	}
+	if call.Parent != nil {
+		if err := writeJSON(filepath.Join(path, "parent.json"), call.Parent); err != nil {
+			return err
+		}
+	}
+	if len(call.Calls) > 0 {
+		if err := writeJSON(filepath.Join(path, "calls.json"), call.Calls); err != nil {
+			return err
+		}
+	}
+	if call.Version > 0 {
+		if err := writeJSON(filepath.Join(path, "version.json"), call.Version); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
-func SaveTransfers(call *Call, transfers []Transfer) error {
-	csv := make([]string, len(transfers))
-	for i, transfer := range transfers {
-		csv[i] = fmt.Sprintf("%s,%d,%s", transfer.From, transfer.Msatoshi, transfer.To)
+// ParseTransfers reads the contents of a transfers.csv file.
+func ParseTransfers(csv []byte) (transfers []Transfer) {
+	for _, line := range strings.Split(string(csv), "\n") {
+		spl := strings.Split(line, ",")
+		if len(spl) != 3 {
+			continue
+		}
+		msatoshi, _ := strconv.ParseInt(spl[1], 10, 64)
+		transfers = append(transfers, Transfer{
+			From:     spl[0],
+			To:       spl[2],
+			Msatoshi: msatoshi,
+		})
 	}
+	return transfers
+}
 
-	return writeFile(
+func SaveTransfers(call *Call, transfers []Transfer) error {
+	return writeTransfers(
 		filepath.Join(DatabasePath,
 			"contracts", call.ContractId,
 			"calls", call.Id[1:2], call.Id,
 			"transfers.csv",
 		),
-		[]byte(strings.Join(csv, "\n")),
+		transfers,
 	)
 }
+
+func writeTransfers(path string, transfers []Transfer) error {
+	csv := make([]string, len(transfers))
+	for i, transfer := range transfers {
+		csv[i] = fmt.Sprintf("%s,%d,%s", transfer.From, transfer.Msatoshi, transfer.To)
+	}
+
+	return writeFile(path, []byte(strings.Join(csv, "\n")))
+}
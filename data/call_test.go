@@ -0,0 +1,56 @@
+package data
+
+import (
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// testDatabase points DatabasePath to an empty git database for the test.
+func testDatabase(t *testing.T) {
+	t.Helper()
+
+	nop := zerolog.Nop()
+	log = &nop
+
+	previous := DatabasePath
+	t.Cleanup(func() { DatabasePath = previous })
+
+	DatabasePath = t.TempDir()
+	if out, err := exec.Command("git", "-C", DatabasePath, "init", "-q").CombinedOutput(); err != nil {
+		t.Fatalf("git init: %s %s", err, out)
+	}
+}
+
+func TestCallGas(t *testing.T) {
+	testDatabase(t)
+
+	call := &Call{
+		Id:         "rgas",
+		ContractId: "cgas",
+		Method:     "f",
+		Payload:    []byte(`{}`),
+		Time:       time.Unix(1600000000, 0),
+		GasUsed:    12300,
+	}
+	if err := SaveCall(call); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(DatabasePath, "contracts", "cgas", "calls", "g", "rgas", "gas.json")
+	var gas int64
+	if err := readJSON(path, &gas); err != nil || gas != 12300 {
+		t.Fatalf("gas.json has %d (%v), expected 12300", gas, err)
+	}
+
+	saved, err := GetCall("cgas", "rgas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.GasUsed != 12300 {
+		t.Fatalf("got gas used %d, expected 12300", saved.GasUsed)
+	}
+}
@@ -1,20 +1,20 @@
 package data
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/fs"
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"regexp"
+	"sort"
 	"strings"
-)
+	"time"
 
-var (
-	functionRe = regexp.MustCompile(`^function +([^_][\w_]+) *\(`)
-	paramRe    = regexp.MustCompile(`\bcall.payload\.([\w_]+)`)
-	authRe     = regexp.MustCompile(`\b(account.send|account.id|account.get_balance)\b`)
-	endRe      = regexp.MustCompile(`^end\b`)
+	"github.com/fiatjaf/etleneum/data/luaparse"
 )
 
 type Contract struct {
@@ -25,12 +25,33 @@ type Contract struct {
 	State   json.RawMessage `json:"state,omitempty"`
 	Funds   int64           `json:"funds"` // contract balance in msats
 	Methods []Method        `json:"methods"`
+	Owner   string          `json:"owner,omitempty"` // account that can upgrade it
+	Version int             `json:"version,omitempty"`
+
+	// libraries are contracts with just functions to be used by others
+	Library   bool              `json:"library,omitempty"`
+	Libraries map[string]string `json:"libraries,omitempty"` // id: sha256 of code
+
+	hasInit bool
 }
 
 type Method struct {
-	Name   string   `json:"name"`
-	Params []string `json:"params"`
-	Auth   bool     `json:"auth"`
+	Name        string   `json:"name"`
+	Params      []string `json:"params"`
+	Auth        bool     `json:"auth"`
+	Description string   `json:"description,omitempty"`
+	Price       int64    `json:"price,omitempty"`  // minimum msatoshi for calls
+	Schema      *Schema  `json:"schema,omitempty"` // from the ---@param annotations
+}
+
+// GetMethod returns the method with the given name, or nil.
+func (ct *Contract) GetMethod(name string) *Method {
+	for i := range ct.Methods {
+		if ct.Methods[i].Name == name {
+			return &ct.Methods[i]
+		}
+	}
+	return nil
 }
 
 func ListContracts() (contracts []Contract, err error) {
@@ -51,12 +72,15 @@ func ListContracts() (contracts []Contract, err error) {
 			readmeb, _ := ioutil.ReadFile(filepath.Join(path, "README.md"))
 			var funds int64
 			readJSON(filepath.Join(path, "funds.json"), &funds)
+			var library bool
+			readJSON(filepath.Join(path, "library.json"), &library)
 
 			contracts = append(contracts, Contract{
-				Id:     filepath.Base(path),
-				Name:   string(nameb),
-				Readme: string(readmeb),
-				Funds:  funds,
+				Id:      filepath.Base(path),
+				Name:    string(nameb),
+				Readme:  string(readmeb),
+				Funds:   funds,
+				Library: library,
 			})
 
 			if info.IsDir() {
@@ -114,7 +138,30 @@ func GetContract(id string) (contract *Contract, err error) {
 		State:  state,
 		Funds:  funds,
 	}
-	parseContractCode(contract)
+	if ownerb, err := ioutil.ReadFile(filepath.Join(path, "owner.txt")); err == nil {
+		contract.Owner = string(ownerb)
+	}
+	contract.Version = 1
+	var versions []Version
+	if err := readJSON(filepath.Join(path, "versions.json"), &versions); err == nil {
+		contract.Version = len(versions)
+	}
+	readJSON(filepath.Join(path, "library.json"), &contract.Library)
+	readJSON(filepath.Join(path, "libraries.json"), &contract.Libraries)
+	if !contract.Library {
+		// code is checked before it is saved, so this only fails if the parser
+		// has changed since then. annotations that aren't accepted anymore are
+		// skipped, but the methods are kept.
+		ignored, err := parseContractCode(contract, false)
+		if err != nil {
+			log.Warn().Err(err).Str("contract", id).
+				Msg("failed to parse contract code")
+		}
+		for _, err := range ignored {
+			log.Warn().Err(err).Str("contract", id).
+				Msg("ignoring invalid annotation")
+		}
+	}
 
 	return contract, nil
 }
@@ -124,6 +171,9 @@ func CreateContract(
 	name string,
 	readme string,
 	code string,
+	owner string,
+	library bool,
+	libraries map[string]string,
 ) error {
 	path := filepath.Join(DatabasePath, "contracts", id)
 	if err := os.MkdirAll(path, 0o700); err != nil {
@@ -148,6 +198,28 @@ func CreateContract(
 	if err := os.Mkdir(filepath.Join(path, "calls"), 0o700); err != nil {
 		return err
 	}
+	first := Version{Version: 1, CodeHash: CodeHash(code), Time: time.Now()}
+	if !library {
+		first.Call = id // the __init__ call
+	}
+	if err := writeJSON(filepath.Join(path, "versions.json"), []Version{first}); err != nil {
+		return err
+	}
+	if owner != "" {
+		if err := writeFile(filepath.Join(path, "owner.txt"), []byte(owner)); err != nil {
+			return err
+		}
+	}
+	if library {
+		if err := writeJSON(filepath.Join(path, "library.json"), true); err != nil {
+			return err
+		}
+	}
+	if len(libraries) > 0 {
+		if err := writeJSON(filepath.Join(path, "libraries.json"), libraries); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -166,6 +238,19 @@ func SaveContractFunds(id string, msatoshi int64) error {
 	)
 }
 
+// GetContractOwner reads just the owner, for checking it again under the lock.
+func GetContractOwner(id string) string {
+	ownerb, _ := ioutil.ReadFile(filepath.Join(DatabasePath, "contracts", id, "owner.txt"))
+	return string(ownerb)
+}
+
+func SaveContractOwner(id string, owner string) error {
+	return writeFile(
+		filepath.Join(DatabasePath, "contracts", id, "owner.txt"),
+		[]byte(owner),
+	)
+}
+
 func DeleteContract(id string) error {
 	path := filepath.Join(DatabasePath, "contracts", id)
 	if _, err := os.Stat(path); os.IsNotExist(err) {
@@ -187,41 +272,183 @@ func DeleteContract(id string) error {
 	return nil
 }
 
-func parseContractCode(ct *Contract) {
+// CodeHash is how the code of libraries is pinned by the contracts that use
+// them.
+func CodeHash(code string) string {
+	hash := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(hash[:])
+}
+
+// RequiredLibraries returns the ids of the libraries loaded with require().
+func RequiredLibraries(code string) (ids []string) {
+	chunk, err := luaparse.Parse(code)
+	if err != nil {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	luaparse.Walk(chunk, func(node luaparse.Node) bool {
+		call, ok := node.(*luaparse.Call)
+		if !ok || !isName(call.Fn, "require") || len(call.Args) != 1 {
+			return true
+		}
+		if id, ok := call.Args[0].(*luaparse.String); ok &&
+			strings.HasPrefix(id.Value, "c") && !seen[id.Value] {
+			seen[id.Value] = true
+			ids = append(ids, id.Value)
+		}
+		return true
+	})
+	return ids
+}
+
+// CheckContractCode returns the first syntax or annotation error in the code.
+func CheckContractCode(code string, library bool) error {
+	ct := &Contract{Code: code}
+	if _, err := parseContractCode(ct, true); err != nil {
+		return err
+	}
+
+	// libraries have no state, so they can't be initialized
+	if library && ct.hasInit {
+		return errors.New("libraries can't have an __init__ function")
+	} else if !library && !ct.hasInit {
+		return errors.New("missing __init__ function")
+	}
+	return nil
+}
+
+// parseContractCode finds the methods of the contract, which are the global
+// functions defined at the top level of the code. when not strict, methods
+// with invalid annotations are kept without them and the errors are returned
+// as ignored.
+func parseContractCode(ct *Contract, strict bool) (ignored []error, err error) {
+	chunk, err := luaparse.Parse(ct.Code)
+	if err != nil {
+		return nil, err
+	}
+
 	lines := strings.Split(ct.Code, "\n")
+	ct.Methods = nil
+	for _, stat := range chunk.Stats {
+		fns := topLevelFunctions(stat)
+		names := make([]string, 0, len(fns))
+		for name := range fns {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			fn := fns[name]
+			if name == "__init__" {
+				ct.hasInit = true
+			}
+			if name[0] == '_' {
+				continue
+			}
+
+			method, err := parseMethod(name, fn, annotationsAbove(lines, stat.Line()))
+			if err != nil {
+				err = fmt.Errorf("method %s (line %d): %w", name, stat.Line(), err)
+				if strict {
+					return nil, err
+				}
+				ignored = append(ignored, err)
+				method, _ = parseMethod(name, fn, nil)
+			}
 
-	var currentMethod *Method
-	var params map[string]bool
-	for _, line := range lines {
-		if matches := functionRe.FindStringSubmatch(line); len(matches) == 2 {
-			currentMethod = &Method{
-				Name:   matches[1],
-				Params: make([]string, 0, 3),
+			// a function defined again replaces the previous one
+			if existing := ct.GetMethod(name); existing != nil {
+				*existing = method
+			} else {
+				ct.Methods = append(ct.Methods, method)
 			}
-			params = make(map[string]bool)
 		}
+	}
 
-		if currentMethod == nil {
-			continue
+	return ignored, nil
+}
+
+// topLevelFunctions returns the global functions a statement defines, either
+// as function name () or as name = function () .
+func topLevelFunctions(stat luaparse.Node) map[string]*luaparse.Function {
+	fns := make(map[string]*luaparse.Function)
+	switch stat := stat.(type) {
+	case *luaparse.FunctionStat:
+		if len(stat.Path) == 1 && stat.Method == "" {
+			fns[stat.Path[0]] = stat.Func
 		}
+	case *luaparse.Assign:
+		for i, target := range stat.Targets {
+			name, ok := target.(*luaparse.Name)
+			if !ok || i >= len(stat.Exprs) {
+				continue
+			}
+			if fn, ok := stat.Exprs[i].(*luaparse.Function); ok {
+				fns[name.Name] = fn
+			}
+		}
+	}
+	return fns
+}
+
+func parseMethod(name string, fn *luaparse.Function, annotations []string) (Method, error) {
+	method := Method{Name: name, Params: make([]string, 0, 3)}
+	if err := parseAnnotations(&method, annotations); err != nil {
+		return method, err
+	}
 
-		if authRe.MatchString(line) {
-			currentMethod.Auth = true
+	params := make(map[string]bool)
+	if method.Schema != nil {
+		for param := range method.Schema.Properties {
+			params[param] = true
 		}
+	}
 
-		matches := paramRe.FindAllStringSubmatch(line, -1)
-		for _, match := range matches {
-			params[match[1]] = true
+	luaparse.Walk(fn.Body, func(node luaparse.Node) bool {
+		index, ok := node.(*luaparse.Index)
+		if !ok {
+			return true
 		}
 
-		if endRe.MatchString(line) {
-			for param := range params {
-				currentMethod.Params = append(currentMethod.Params, param)
-			}
+		// account.*
+		if isName(index.Obj, "account") {
+			method.Auth = true
+		}
 
-			ct.Methods = append(ct.Methods, *currentMethod)
-			currentMethod = nil
-			params = nil
+		// call.payload.*
+		if payload, ok := index.Obj.(*luaparse.Index); ok &&
+			isName(payload.Obj, "call") && isString(payload.Key, "payload") {
+			if key, ok := index.Key.(*luaparse.String); ok {
+				params[key.Value] = true
+			}
 		}
+		return true
+	})
+
+	for param := range params {
+		method.Params = append(method.Params, param)
+	}
+	sort.Strings(method.Params)
+
+	return method, nil
+}
+
+// annotationsAbove returns the --- comment lines right above a line.
+func annotationsAbove(lines []string, line int) []string {
+	start := line - 1
+	for start > 0 && strings.HasPrefix(strings.TrimSpace(lines[start-1]), "---") {
+		start--
 	}
+	return lines[start : line-1]
+}
+
+func isName(node luaparse.Node, name string) bool {
+	n, ok := node.(*luaparse.Name)
+	return ok && n.Name == name
+}
+
+func isString(node luaparse.Node, value string) bool {
+	s, ok := node.(*luaparse.String)
+	return ok && s.Value == value
 }
@@ -49,6 +49,11 @@ func Abort() {
 	mutex.Unlock()
 }
 
+// Unlock is like Abort, for when nothing was written.
+func Unlock() {
+	mutex.Unlock()
+}
+
 func Finish(message string) {
 	err := gitCommit(message)
 	if err != nil {
@@ -0,0 +1,106 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type Event struct {
+	Call string          `json:"call,omitempty"` // only set when listing
+	Name string          `json:"name"`
+	Data json.RawMessage `json:"data"`
+	Time time.Time       `json:"time"` // of the call
+}
+
+// every call that has emitted events gets a file in the events directory of
+// the contract, named after the call time so a listing is already sorted,
+// with the names of these events, one per line.
+func eventsIndexEntry(call *Call) string {
+	return filepath.Join(DatabasePath, "contracts", call.ContractId, "events",
+		fmt.Sprintf("%012d-%s", call.Time.Unix(), call.Id))
+}
+
+func saveEventsIndex(call *Call) error {
+	path := eventsIndexEntry(call)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	names := make([]string, len(call.Events))
+	for i, event := range call.Events {
+		names[i] = event.Name
+	}
+	return writeFile(path, []byte(strings.Join(names, "\n")))
+}
+
+// ListContractEvents returns the events emitted by all calls of a contract,
+// the most recent first, optionally filtered by name. only the calls needed
+// for the requested page are read.
+func ListContractEvents(contract string, name string, limit, offset int) (
+	events []Event,
+	err error,
+) {
+	indexPath := filepath.Join(DatabasePath, "contracts", contract, "events")
+	entries, err := ioutil.ReadDir(indexPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for i := len(entries) - 1; i >= 0 && len(events) < offset+limit; i-- {
+		spl := strings.SplitN(entries[i].Name(), "-", 2)
+		if len(spl) != 2 || len(spl[1]) < 2 {
+			continue
+		}
+		callId := spl[1]
+
+		if name != "" {
+			names, err := ioutil.ReadFile(filepath.Join(indexPath, entries[i].Name()))
+			if err != nil {
+				return nil, err
+			}
+			found := false
+			for _, n := range strings.Split(string(names), "\n") {
+				if n == name {
+					found = true
+					break
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+
+		path := filepath.Join(DatabasePath, "contracts", contract,
+			"calls", callId[1:2], callId, "events.json")
+		var callEvents []Event
+		if err := readJSON(path, &callEvents); err != nil {
+			log.Warn().Err(err).Str("path", path).Msg("error reading events")
+			continue
+		}
+
+		for _, event := range callEvents {
+			if name != "" && event.Name != name {
+				continue
+			}
+			event.Call = callId
+			events = append(events, event)
+		}
+	}
+
+	if offset > len(events) {
+		offset = len(events)
+	}
+	events = events[offset:]
+	if limit < len(events) {
+		events = events[:limit]
+	}
+
+	return events, nil
+}
@@ -46,3 +46,10 @@ func writeJSON(path string, contents interface{}) error {
 
 	return nil
 }
+
+// derivedId is the id of the nth thing of some kind created during a call,
+// with the call id prefix replaced. the separator keeps ids from different
+// calls apart, as call ids may end with digits.
+func derivedId(prefix string, call string, n int) string {
+	return fmt.Sprintf("%s%s-%d", prefix, call[1:], n)
+}
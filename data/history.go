@@ -0,0 +1,104 @@
+package data
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Commit is a point in the history of the git database.
+type Commit struct {
+	Hash    string
+	Time    time.Time
+	Message string
+}
+
+// ContractHistory returns all the commits that have touched a contract,
+// oldest first.
+func ContractHistory(id string) (commits []Commit, err error) {
+	out, err := gitOutput("log", "--reverse", "--format=%H %at %s",
+		"--", path.Join("contracts", id))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		spl := strings.SplitN(line, " ", 3)
+		if len(spl) != 3 {
+			continue
+		}
+		timestamp, _ := strconv.ParseInt(spl[1], 10, 64)
+		commits = append(commits, Commit{
+			Hash:    spl[0],
+			Time:    time.Unix(timestamp, 0),
+			Message: spl[2],
+		})
+	}
+
+	return commits, nil
+}
+
+// FilesAddedAt returns the paths of the files added by a commit inside dir
+// (relative to the database root).
+func FilesAddedAt(commit string, dir string) (paths []string, err error) {
+	out, err := gitOutput("diff-tree", "--root", "--no-commit-id", "--name-only",
+		"--diff-filter=A", "-r", commit, "--", dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if line != "" {
+			paths = append(paths, line)
+		}
+	}
+	return paths, nil
+}
+
+// ReadFileAt reads a file (relative to the database root) as it was at the
+// given commit, use commit + "^" to read it as it was right before.
+func ReadFileAt(commit string, filepath string) ([]byte, error) {
+	out, err := gitOutput("show", commit+":"+filepath)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(out), nil
+}
+
+// ReadJSONAt is like ReadFileAt, but for JSON files.
+func ReadJSONAt(commit string, filepath string, out interface{}) error {
+	b, err := ReadFileAt(commit, filepath)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, out)
+}
+
+// GetCallAt reads a call as it was saved at the given commit.
+func GetCallAt(commit string, contract string, id string) (*Call, error) {
+	dir := path.Join("contracts", contract, "calls", id[1:2], id)
+	return readCall(contract, id, func(name string) ([]byte, error) {
+		return ReadFileAt(commit, path.Join(dir, name))
+	})
+}
+
+func gitOutput(args ...string) (string, error) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = DatabasePath
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s: %s", args[0], strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.String(), nil
+}
@@ -0,0 +1,158 @@
+package data
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Hold is an amount taken from an account balance and reserved for a
+// contract until it is captured, released or expires.
+type Hold struct {
+	Id         string    `json:"id"`
+	ContractId string    `json:"contract_id"`
+	Account    string    `json:"account"`
+	Msatoshi   int64     `json:"msatoshi"`
+	Expiry     time.Time `json:"expiry"` // when the funds go back to the account
+	Call       string    `json:"call"`   // the call that has created this
+}
+
+// HoldId is the id of the nth hold created during a call. It is derived from
+// the call id so replaying the call gives the same ids.
+func HoldId(call string, n int) string {
+	return derivedId("h", call, n)
+}
+
+func SaveHold(hold Hold) error {
+	path := filepath.Join(DatabasePath, "accounts", hold.Account, "holds")
+	if err := os.MkdirAll(path, 0o700); err != nil {
+		return err
+	}
+
+	return writeJSON(filepath.Join(path, hold.Id+".json"), hold)
+}
+
+// SaveExpiredHold records the funds of an expired hold going back to its
+// account. holds captured or released by a contract have that recorded in the
+// transfers of the call instead.
+func SaveExpiredHold(hold Hold) error {
+	path := filepath.Join(DatabasePath, "contracts", hold.ContractId, "holds", hold.Id)
+	if err := os.MkdirAll(path, 0o700); err != nil {
+		return err
+	}
+
+	return writeTransfers(filepath.Join(path, "transfers.csv"), []Transfer{
+		{From: hold.Id, To: hold.Account, Msatoshi: hold.Msatoshi},
+	})
+}
+
+func GetHold(id string) (hold *Hold, err error) {
+	if id == "" || strings.ContainsAny(id, "/\\*?[") {
+		return nil, fmt.Errorf("invalid hold id %s", id)
+	}
+
+	matches, err := filepath.Glob(
+		filepath.Join(DatabasePath, "accounts", "*", "holds", id+".json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("hold %s not found", id)
+	} else if len(matches) > 1 {
+		return nil, fmt.Errorf("hold %s found on %d accounts", id, len(matches))
+	}
+
+	hold = &Hold{}
+	if err := readJSON(matches[0], hold); err != nil {
+		return nil, err
+	}
+	return hold, nil
+}
+
+// ListHolds returns the holds on an account, the ones expiring first first.
+func ListHolds(account string) (holds []Hold, err error) {
+	path := filepath.Join(DatabasePath, "accounts", account, "holds")
+	entries, err := ioutil.ReadDir(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		var hold Hold
+		if err := readJSON(filepath.Join(path, entry.Name()), &hold); err != nil {
+			return nil, err
+		}
+		holds = append(holds, hold)
+	}
+
+	sort.Slice(holds, func(i, j int) bool {
+		return holds[i].Expiry.Before(holds[j].Expiry)
+	})
+
+	return holds, nil
+}
+
+// ListExpiredHolds returns the holds on all accounts that have expired before
+// the given time.
+func ListExpiredHolds(now time.Time) (expired []Hold, err error) {
+	entries, err := ioutil.ReadDir(filepath.Join(DatabasePath, "accounts"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		holds, err := ListHolds(entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("failed to list holds for %s: %w",
+				entry.Name(), err)
+		}
+
+		for _, hold := range holds {
+			if hold.Expiry.After(now) {
+				break
+			}
+			expired = append(expired, hold)
+		}
+	}
+
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i].Expiry.Before(expired[j].Expiry)
+	})
+
+	return expired, nil
+}
+
+// GetAccountReserved returns the sum of all holds on an account.
+func GetAccountReserved(key string) (msatoshi int64) {
+	holds, err := ListHolds(key)
+	if err != nil {
+		log.Warn().Err(err).Str("account", key).Msg("error listing holds")
+		return 0
+	}
+
+	for _, hold := range holds {
+		msatoshi += hold.Msatoshi
+	}
+	return msatoshi
+}
+
+func DeleteHold(account string, id string) error {
+	path := filepath.Join(DatabasePath, "accounts", account, "holds", id+".json")
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+
+	return gitAdd(path)
+}
@@ -0,0 +1,275 @@
+// Package luaparse is a parser for Lua 5.3 code, so contracts can be inspected
+// without running them.
+package luaparse
+
+// a minimal Lua 5.3 syntax tree, enough to find the methods of a contract and
+// what they do. every node knows the line where it starts.
+
+type Node interface {
+	Line() int
+}
+
+type Block struct {
+	line  int
+	Stats []Node
+}
+
+func (n *Block) Line() int { return n.line }
+
+// expressions
+
+type (
+	Nil    struct{ line int }
+	True   struct{ line int }
+	False  struct{ line int }
+	Vararg struct{ line int }
+	Number struct {
+		line  int
+		Value string
+	}
+	String struct {
+		line  int
+		Value string
+	}
+	Name struct {
+		line int
+		Name string
+	}
+	Index struct {
+		line int
+		Obj  Node
+		Key  Node
+	}
+	Call struct {
+		line int
+		Fn   Node
+		Args []Node
+	}
+	MethodCall struct {
+		line int
+		Obj  Node
+		Name string
+		Args []Node
+	}
+	Function struct {
+		line     int
+		Params   []string
+		IsVararg bool
+		Body     *Block
+	}
+	Table struct {
+		line   int
+		Fields []TableField
+	}
+	BinOp struct {
+		line int
+		Op   string
+		L    Node
+		R    Node
+	}
+	UnOp struct {
+		line int
+		Op   string
+		X    Node
+	}
+	Paren struct {
+		line int
+		X    Node
+	}
+)
+
+// TableField is either [Key] = Value, name = Value (with Key as a String) or
+// just Value (with a nil Key).
+type TableField struct {
+	Key   Node
+	Value Node
+}
+
+func (n *Nil) Line() int        { return n.line }
+func (n *True) Line() int       { return n.line }
+func (n *False) Line() int      { return n.line }
+func (n *Vararg) Line() int     { return n.line }
+func (n *Number) Line() int     { return n.line }
+func (n *String) Line() int     { return n.line }
+func (n *Name) Line() int       { return n.line }
+func (n *Index) Line() int      { return n.line }
+func (n *Call) Line() int       { return n.line }
+func (n *MethodCall) Line() int { return n.line }
+func (n *Function) Line() int   { return n.line }
+func (n *Table) Line() int      { return n.line }
+func (n *BinOp) Line() int      { return n.line }
+func (n *UnOp) Line() int       { return n.line }
+func (n *Paren) Line() int      { return n.line }
+
+// statements
+
+type (
+	Local struct {
+		line  int
+		Names []string
+		Exprs []Node
+	}
+	Assign struct {
+		line    int
+		Targets []Node
+		Exprs   []Node
+	}
+	CallStat struct {
+		line int
+		Call Node // Call or MethodCall
+	}
+	Do struct {
+		line int
+		Body *Block
+	}
+	While struct {
+		line int
+		Cond Node
+		Body *Block
+	}
+	Repeat struct {
+		line int
+		Body *Block
+		Cond Node
+	}
+	If struct {
+		line   int
+		Conds  []Node
+		Blocks []*Block
+		Else   *Block
+	}
+	NumFor struct {
+		line  int
+		Var   string
+		Start Node
+		Limit Node
+		Step  Node
+		Body  *Block
+	}
+	GenFor struct {
+		line  int
+		Names []string
+		Exprs []Node
+		Body  *Block
+	}
+	// FunctionStat is function a.b.c:m () end, Path is [a b c] and Method is m.
+	FunctionStat struct {
+		line   int
+		Path   []string
+		Method string
+		Func   *Function
+	}
+	LocalFunction struct {
+		line int
+		Name string
+		Func *Function
+	}
+	Return struct {
+		line  int
+		Exprs []Node
+	}
+	Break struct{ line int }
+	Goto  struct {
+		line  int
+		Label string
+	}
+	Label struct {
+		line int
+		Name string
+	}
+)
+
+func (n *Local) Line() int         { return n.line }
+func (n *Assign) Line() int        { return n.line }
+func (n *CallStat) Line() int      { return n.line }
+func (n *Do) Line() int            { return n.line }
+func (n *While) Line() int         { return n.line }
+func (n *Repeat) Line() int        { return n.line }
+func (n *If) Line() int            { return n.line }
+func (n *NumFor) Line() int        { return n.line }
+func (n *GenFor) Line() int        { return n.line }
+func (n *FunctionStat) Line() int  { return n.line }
+func (n *LocalFunction) Line() int { return n.line }
+func (n *Return) Line() int        { return n.line }
+func (n *Break) Line() int         { return n.line }
+func (n *Goto) Line() int          { return n.line }
+func (n *Label) Line() int         { return n.line }
+
+// Walk calls fn for node and all the nodes inside it, depth-first. if fn
+// returns false the children of that node are skipped.
+func Walk(node Node, fn func(Node) bool) {
+	if node == nil || !fn(node) {
+		return
+	}
+
+	walkAll := func(nodes []Node) {
+		for _, n := range nodes {
+			Walk(n, fn)
+		}
+	}
+
+	switch n := node.(type) {
+	case *Block:
+		walkAll(n.Stats)
+	case *Index:
+		Walk(n.Obj, fn)
+		Walk(n.Key, fn)
+	case *Call:
+		Walk(n.Fn, fn)
+		walkAll(n.Args)
+	case *MethodCall:
+		Walk(n.Obj, fn)
+		walkAll(n.Args)
+	case *Function:
+		Walk(n.Body, fn)
+	case *Table:
+		for _, field := range n.Fields {
+			Walk(field.Key, fn)
+			Walk(field.Value, fn)
+		}
+	case *BinOp:
+		Walk(n.L, fn)
+		Walk(n.R, fn)
+	case *UnOp:
+		Walk(n.X, fn)
+	case *Paren:
+		Walk(n.X, fn)
+	case *Local:
+		walkAll(n.Exprs)
+	case *Assign:
+		walkAll(n.Targets)
+		walkAll(n.Exprs)
+	case *CallStat:
+		Walk(n.Call, fn)
+	case *Do:
+		Walk(n.Body, fn)
+	case *While:
+		Walk(n.Cond, fn)
+		Walk(n.Body, fn)
+	case *Repeat:
+		Walk(n.Body, fn)
+		Walk(n.Cond, fn)
+	case *If:
+		for i := range n.Conds {
+			Walk(n.Conds[i], fn)
+			Walk(n.Blocks[i], fn)
+		}
+		if n.Else != nil {
+			Walk(n.Else, fn)
+		}
+	case *NumFor:
+		Walk(n.Start, fn)
+		Walk(n.Limit, fn)
+		Walk(n.Step, fn)
+		Walk(n.Body, fn)
+	case *GenFor:
+		walkAll(n.Exprs)
+		Walk(n.Body, fn)
+	case *FunctionStat:
+		Walk(n.Func, fn)
+	case *LocalFunction:
+		Walk(n.Func, fn)
+	case *Return:
+		walkAll(n.Exprs)
+	}
+}
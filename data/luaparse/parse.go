@@ -0,0 +1,752 @@
+package luaparse
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// SyntaxError is what Parse returns when the code is not valid Lua.
+type SyntaxError struct {
+	Line    int
+	Message string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// Parse parses Lua 5.3 code into a Block.
+func Parse(code string) (block *Block, err error) {
+	p := &luaParser{lex: &luaLexer{src: code, line: 1}}
+
+	defer func() {
+		if r := recover(); r != nil {
+			if serr, ok := r.(*SyntaxError); ok {
+				block = nil
+				err = serr
+				return
+			}
+			panic(r)
+		}
+	}()
+
+	p.next()
+	block = p.block()
+	if p.tok.kind != tEOF {
+		p.errorExpected("<eof>")
+	}
+	return block, nil
+}
+
+// lexer
+
+const (
+	tEOF = iota
+	tName
+	tKeyword
+	tNumber
+	tString
+	tSymbol
+)
+
+type luaToken struct {
+	kind  int
+	value string // the name, keyword, symbol or decoded string
+	line  int
+}
+
+func (t luaToken) String() string {
+	switch t.kind {
+	case tEOF:
+		return "<eof>"
+	case tString:
+		return strconv.Quote(t.value)
+	default:
+		return "'" + t.value + "'"
+	}
+}
+
+var luaKeywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true,
+	"end": true, "false": true, "for": true, "function": true, "goto": true,
+	"if": true, "in": true, "local": true, "nil": true, "not": true, "or": true,
+	"repeat": true, "return": true, "then": true, "true": true, "until": true,
+	"while": true,
+}
+
+// longest first so we always match the biggest symbol
+var luaSymbols = []string{
+	"...", "..", "::", "<<", ">>", "//", "==", "~=", "<=", ">=",
+	"+", "-", "*", "/", "%", "^", "#", "&", "~", "|", "<", ">", "=",
+	"(", ")", "{", "}", "[", "]", ";", ":", ",", ".",
+}
+
+type luaLexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+func (l *luaLexer) fail(msg string) {
+	panic(&SyntaxError{Line: l.line, Message: msg})
+}
+
+func (l *luaLexer) peek(n int) byte {
+	if l.pos+n < len(l.src) {
+		return l.src[l.pos+n]
+	}
+	return 0
+}
+
+func (l *luaLexer) scan() luaToken {
+	// skip spaces and comments
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		if c == '\n' {
+			l.line++
+			l.pos++
+		} else if c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v' {
+			l.pos++
+		} else if c == '-' && l.peek(1) == '-' {
+			l.pos += 2
+			if l.peek(0) == '[' {
+				if level := l.longBracketLevel(); level >= 0 {
+					l.longString(level, "comment")
+					continue
+				}
+			}
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		} else {
+			break
+		}
+	}
+
+	if l.pos >= len(l.src) {
+		return luaToken{kind: tEOF, line: l.line}
+	}
+
+	line := l.line
+	c := l.src[l.pos]
+
+	switch {
+	case isLuaNameStart(c):
+		start := l.pos
+		for l.pos < len(l.src) && isLuaNameChar(l.src[l.pos]) {
+			l.pos++
+		}
+		word := l.src[start:l.pos]
+		if luaKeywords[word] {
+			return luaToken{kind: tKeyword, value: word, line: line}
+		}
+		return luaToken{kind: tName, value: word, line: line}
+
+	case isDigit(c) || (c == '.' && isDigit(l.peek(1))):
+		return luaToken{kind: tNumber, value: l.number(), line: line}
+
+	case c == '"' || c == '\'':
+		return luaToken{kind: tString, value: l.shortString(c), line: line}
+
+	case c == '[':
+		if level := l.longBracketLevel(); level >= 0 {
+			return luaToken{kind: tString, value: l.longString(level, "string"), line: line}
+		}
+	}
+
+	for _, sym := range luaSymbols {
+		if strings.HasPrefix(l.src[l.pos:], sym) {
+			l.pos += len(sym)
+			return luaToken{kind: tSymbol, value: sym, line: line}
+		}
+	}
+
+	l.fail(fmt.Sprintf("unexpected symbol '%c'", c))
+	return luaToken{}
+}
+
+func isLuaNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isLuaNameChar(c byte) bool { return isLuaNameStart(c) || isDigit(c) }
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func (l *luaLexer) number() string {
+	start := l.pos
+	digit, exponent := isDigit, "eE"
+	if l.peek(0) == '0' && (l.peek(1) == 'x' || l.peek(1) == 'X') {
+		l.pos += 2
+		digit, exponent = isHexDigit, "pP"
+	}
+
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		if strings.IndexByte(exponent, c) != -1 {
+			l.pos++
+			if l.peek(0) == '+' || l.peek(0) == '-' {
+				l.pos++
+			}
+		} else if digit(c) || c == '.' {
+			l.pos++
+		} else {
+			break
+		}
+	}
+
+	// a number can't be followed by a name, like in 3x
+	if l.pos < len(l.src) && isLuaNameChar(l.src[l.pos]) {
+		l.pos++
+		l.fail("malformed number near '" + l.src[start:l.pos] + "'")
+	}
+
+	n := l.src[start:l.pos]
+	// (hex integers and overflows are fine)
+	_, err := strconv.ParseFloat(n, 64)
+	if nerr, ok := err.(*strconv.NumError); ok && nerr.Err == strconv.ErrSyntax &&
+		!strings.ContainsAny(n, "xX") {
+		l.fail("malformed number near '" + n + "'")
+	}
+	return n
+}
+
+// longBracketLevel returns the number of = in [==[ at the current position or
+// -1 if it isn't a long bracket.
+func (l *luaLexer) longBracketLevel() int {
+	level := 0
+	for l.peek(1+level) == '=' {
+		level++
+	}
+	if l.peek(1+level) == '[' {
+		return level
+	}
+	return -1
+}
+
+func (l *luaLexer) longString(level int, what string) string {
+	startLine := l.line
+	l.pos += level + 2
+	if l.peek(0) == '\r' {
+		l.pos++
+	}
+	if l.peek(0) == '\n' {
+		// the first newline is skipped
+		l.line++
+		l.pos++
+	}
+
+	closing := "]" + strings.Repeat("=", level) + "]"
+	end := strings.Index(l.src[l.pos:], closing)
+	if end == -1 {
+		l.line = startLine
+		l.fail("unfinished long " + what)
+	}
+
+	value := l.src[l.pos : l.pos+end]
+	l.line += strings.Count(value, "\n")
+	l.pos += end + len(closing)
+	return value
+}
+
+func (l *luaLexer) shortString(quote byte) string {
+	l.pos++
+	var value strings.Builder
+	for {
+		if l.pos >= len(l.src) || l.src[l.pos] == '\n' {
+			l.fail("unfinished string")
+		}
+
+		c := l.src[l.pos]
+		l.pos++
+		if c == quote {
+			return value.String()
+		}
+		if c != '\\' {
+			value.WriteByte(c)
+			continue
+		}
+
+		if l.pos >= len(l.src) {
+			l.fail("unfinished string")
+		}
+		e := l.src[l.pos]
+		l.pos++
+		switch e {
+		case 'n':
+			value.WriteByte('\n')
+		case 't':
+			value.WriteByte('\t')
+		case 'r':
+			value.WriteByte('\r')
+		case 'a':
+			value.WriteByte('\a')
+		case 'b':
+			value.WriteByte('\b')
+		case 'f':
+			value.WriteByte('\f')
+		case 'v':
+			value.WriteByte('\v')
+		case '\\', '"', '\'':
+			value.WriteByte(e)
+		case '\n':
+			l.line++
+			value.WriteByte('\n')
+		case 'x':
+			if !isHexDigit(l.peek(0)) || !isHexDigit(l.peek(1)) {
+				l.fail("hexadecimal digit expected")
+			}
+			b, _ := strconv.ParseUint(l.src[l.pos:l.pos+2], 16, 8)
+			value.WriteByte(byte(b))
+			l.pos += 2
+		case 'z':
+			for l.pos < len(l.src) && strings.IndexByte(" \t\r\n\f\v", l.src[l.pos]) != -1 {
+				if l.src[l.pos] == '\n' {
+					l.line++
+				}
+				l.pos++
+			}
+		case 'u':
+			end := strings.IndexByte(l.src[l.pos:], '}')
+			if l.peek(0) != '{' || end == -1 {
+				l.fail("missing '{' or '}' in \\u{xxxx}")
+			}
+			r, err := strconv.ParseUint(l.src[l.pos+1:l.pos+end], 16, 32)
+			if err != nil {
+				l.fail("invalid unicode escape")
+			}
+			var buf [utf8.UTFMax]byte
+			value.Write(buf[:utf8.EncodeRune(buf[:], rune(r))])
+			l.pos += end + 1
+		default:
+			if !isDigit(e) {
+				l.fail("invalid escape sequence '\\" + string(e) + "'")
+			}
+			digits := string(e)
+			for len(digits) < 3 && isDigit(l.peek(0)) {
+				digits += string(l.src[l.pos])
+				l.pos++
+			}
+			b, _ := strconv.Atoi(digits)
+			if b > 255 {
+				l.fail("decimal escape too large")
+			}
+			value.WriteByte(byte(b))
+		}
+	}
+}
+
+// parser
+
+type luaParser struct {
+	lex *luaLexer
+	tok luaToken
+}
+
+func (p *luaParser) next() { p.tok = p.lex.scan() }
+
+func (p *luaParser) fail(line int, msg string) {
+	panic(&SyntaxError{Line: line, Message: msg})
+}
+
+func (p *luaParser) errorExpected(what string) {
+	p.fail(p.tok.line, fmt.Sprintf("%s expected near %s", what, p.tok))
+}
+
+func (p *luaParser) is(value string) bool {
+	return (p.tok.kind == tKeyword || p.tok.kind == tSymbol) && p.tok.value == value
+}
+
+func (p *luaParser) accept(value string) bool {
+	if p.is(value) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *luaParser) expect(value string) {
+	if !p.accept(value) {
+		p.errorExpected("'" + value + "'")
+	}
+}
+
+// expectClosing is expect for the end of a block, it says where it started.
+func (p *luaParser) expectClosing(value, opening string, line int) {
+	if p.accept(value) {
+		return
+	}
+	if line == p.tok.line {
+		p.errorExpected("'" + value + "'")
+	}
+	p.fail(p.tok.line, fmt.Sprintf("'%s' expected (to close '%s' at line %d) near %s",
+		value, opening, line, p.tok))
+}
+
+func (p *luaParser) name() string {
+	if p.tok.kind != tName {
+		p.errorExpected("<name>")
+	}
+	name := p.tok.value
+	p.next()
+	return name
+}
+
+func (p *luaParser) blockFollows() bool {
+	return p.tok.kind == tEOF ||
+		p.is("end") || p.is("else") || p.is("elseif") || p.is("until")
+}
+
+func (p *luaParser) block() *Block {
+	block := &Block{line: p.tok.line}
+	for !p.blockFollows() {
+		if p.is("return") {
+			block.Stats = append(block.Stats, p.returnStat())
+			break
+		}
+		if stat := p.statement(); stat != nil {
+			block.Stats = append(block.Stats, stat)
+		}
+	}
+	return block
+}
+
+func (p *luaParser) returnStat() Node {
+	ret := &Return{line: p.tok.line}
+	p.next()
+	if !p.blockFollows() && !p.is(";") {
+		ret.Exprs = p.exprList()
+	}
+	p.accept(";")
+	if !p.blockFollows() {
+		p.errorExpected("<eof>")
+	}
+	return ret
+}
+
+func (p *luaParser) statement() Node {
+	line := p.tok.line
+
+	switch {
+	case p.accept(";"):
+		return nil
+
+	case p.accept("if"):
+		stat := &If{line: line}
+		stat.Conds = append(stat.Conds, p.expr())
+		p.expect("then")
+		stat.Blocks = append(stat.Blocks, p.block())
+		for p.is("elseif") {
+			p.next()
+			stat.Conds = append(stat.Conds, p.expr())
+			p.expect("then")
+			stat.Blocks = append(stat.Blocks, p.block())
+		}
+		if p.accept("else") {
+			stat.Else = p.block()
+		}
+		p.expectClosing("end", "if", line)
+		return stat
+
+	case p.accept("while"):
+		stat := &While{line: line, Cond: p.expr()}
+		p.expect("do")
+		stat.Body = p.block()
+		p.expectClosing("end", "while", line)
+		return stat
+
+	case p.accept("do"):
+		stat := &Do{line: line, Body: p.block()}
+		p.expectClosing("end", "do", line)
+		return stat
+
+	case p.accept("for"):
+		first := p.name()
+		if p.accept("=") {
+			stat := &NumFor{line: line, Var: first}
+			stat.Start = p.expr()
+			p.expect(",")
+			stat.Limit = p.expr()
+			if p.accept(",") {
+				stat.Step = p.expr()
+			}
+			p.expect("do")
+			stat.Body = p.block()
+			p.expectClosing("end", "for", line)
+			return stat
+		}
+
+		stat := &GenFor{line: line, Names: []string{first}}
+		for p.accept(",") {
+			stat.Names = append(stat.Names, p.name())
+		}
+		p.expect("in")
+		stat.Exprs = p.exprList()
+		p.expect("do")
+		stat.Body = p.block()
+		p.expectClosing("end", "for", line)
+		return stat
+
+	case p.accept("repeat"):
+		stat := &Repeat{line: line, Body: p.block()}
+		p.expectClosing("until", "repeat", line)
+		stat.Cond = p.expr()
+		return stat
+
+	case p.accept("function"):
+		stat := &FunctionStat{line: line, Path: []string{p.name()}}
+		for p.accept(".") {
+			stat.Path = append(stat.Path, p.name())
+		}
+		if p.accept(":") {
+			stat.Method = p.name()
+		}
+		stat.Func = p.functionBody(line, stat.Method != "")
+		return stat
+
+	case p.accept("local"):
+		if p.accept("function") {
+			return &LocalFunction{line: line, Name: p.name(), Func: p.functionBody(line, false)}
+		}
+		stat := &Local{line: line, Names: []string{p.name()}}
+		for p.accept(",") {
+			stat.Names = append(stat.Names, p.name())
+		}
+		if p.accept("=") {
+			stat.Exprs = p.exprList()
+		}
+		return stat
+
+	case p.accept("::"):
+		stat := &Label{line: line, Name: p.name()}
+		p.expect("::")
+		return stat
+
+	case p.accept("break"):
+		return &Break{line: line}
+
+	case p.accept("goto"):
+		return &Goto{line: line, Label: p.name()}
+	}
+
+	// an assignment or a function call
+	expr := p.suffixedExpr()
+	if p.is("=") || p.is(",") {
+		stat := &Assign{line: line, Targets: []Node{expr}}
+		for p.accept(",") {
+			stat.Targets = append(stat.Targets, p.suffixedExpr())
+		}
+		for _, target := range stat.Targets {
+			switch target.(type) {
+			case *Name, *Index:
+			default:
+				p.fail(target.Line(), "syntax error, can't assign to this")
+			}
+		}
+		p.expect("=")
+		stat.Exprs = p.exprList()
+		return stat
+	}
+
+	switch expr.(type) {
+	case *Call, *MethodCall:
+		return &CallStat{line: line, Call: expr}
+	}
+	p.fail(p.tok.line, "syntax error near "+p.tok.String())
+	return nil
+}
+
+func (p *luaParser) functionBody(line int, isMethod bool) *Function {
+	fn := &Function{line: line}
+	if isMethod {
+		fn.Params = append(fn.Params, "self")
+	}
+
+	p.expect("(")
+	if !p.is(")") {
+		for {
+			if p.accept("...") {
+				fn.IsVararg = true
+				break
+			}
+			fn.Params = append(fn.Params, p.name())
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	p.expect(")")
+
+	fn.Body = p.block()
+	p.expectClosing("end", "function", line)
+	return fn
+}
+
+func (p *luaParser) exprList() []Node {
+	exprs := []Node{p.expr()}
+	for p.accept(",") {
+		exprs = append(exprs, p.expr())
+	}
+	return exprs
+}
+
+func (p *luaParser) primaryExpr() Node {
+	line := p.tok.line
+	if p.tok.kind == tName {
+		return &Name{line: line, Name: p.name()}
+	}
+	if p.accept("(") {
+		expr := &Paren{line: line, X: p.expr()}
+		p.expectClosing(")", "(", line)
+		return expr
+	}
+	p.fail(line, "unexpected symbol near "+p.tok.String())
+	return nil
+}
+
+func (p *luaParser) suffixedExpr() Node {
+	expr := p.primaryExpr()
+	for {
+		line := p.tok.line
+		switch {
+		case p.accept("."):
+			expr = &Index{line: line, Obj: expr, Key: &String{line: line, Value: p.name()}}
+		case p.accept("["):
+			expr = &Index{line: line, Obj: expr, Key: p.expr()}
+			p.expect("]")
+		case p.accept(":"):
+			name := p.name()
+			expr = &MethodCall{line: line, Obj: expr, Name: name, Args: p.callArgs()}
+		case p.is("(") || p.is("{") || p.tok.kind == tString:
+			expr = &Call{line: line, Fn: expr, Args: p.callArgs()}
+		default:
+			return expr
+		}
+	}
+}
+
+func (p *luaParser) callArgs() []Node {
+	line := p.tok.line
+	switch {
+	case p.tok.kind == tString:
+		arg := &String{line: line, Value: p.tok.value}
+		p.next()
+		return []Node{arg}
+	case p.is("{"):
+		return []Node{p.table()}
+	case p.accept("("):
+		var args []Node
+		if !p.is(")") {
+			args = p.exprList()
+		}
+		p.expectClosing(")", "(", line)
+		return args
+	}
+	p.errorExpected("function arguments")
+	return nil
+}
+
+func (p *luaParser) table() Node {
+	line := p.tok.line
+	p.expect("{")
+	table := &Table{line: line}
+	for !p.is("}") {
+		if p.accept("[") {
+			key := p.expr()
+			p.expect("]")
+			p.expect("=")
+			table.Fields = append(table.Fields, TableField{Key: key, Value: p.expr()})
+		} else if p.tok.kind == tName && p.peekIsAssign() {
+			key := &String{line: p.tok.line, Value: p.name()}
+			p.expect("=")
+			table.Fields = append(table.Fields, TableField{Key: key, Value: p.expr()})
+		} else {
+			table.Fields = append(table.Fields, TableField{Value: p.expr()})
+		}
+
+		if !p.accept(",") && !p.accept(";") {
+			break
+		}
+	}
+	p.expectClosing("}", "{", line)
+	return table
+}
+
+// peekIsAssign tells if the token after the current one is a single '='.
+func (p *luaParser) peekIsAssign() bool {
+	saved := *p.lex
+	next := p.lex.scan()
+	*p.lex = saved
+	return next.kind == tSymbol && next.value == "="
+}
+
+func (p *luaParser) simpleExpr() Node {
+	line := p.tok.line
+	switch {
+	case p.tok.kind == tNumber:
+		n := &Number{line: line, Value: p.tok.value}
+		p.next()
+		return n
+	case p.tok.kind == tString:
+		s := &String{line: line, Value: p.tok.value}
+		p.next()
+		return s
+	case p.accept("nil"):
+		return &Nil{line: line}
+	case p.accept("true"):
+		return &True{line: line}
+	case p.accept("false"):
+		return &False{line: line}
+	case p.accept("..."):
+		return &Vararg{line: line}
+	case p.is("{"):
+		return p.table()
+	case p.accept("function"):
+		return p.functionBody(line, false)
+	}
+	return p.suffixedExpr()
+}
+
+// left and right priorities of the binary operators, as in the Lua source
+var luaBinaryPriority = map[string][2]int{
+	"or": {1, 1}, "and": {2, 2},
+	"<": {3, 3}, ">": {3, 3}, "<=": {3, 3}, ">=": {3, 3}, "~=": {3, 3}, "==": {3, 3},
+	"|": {4, 4}, "~": {5, 5}, "&": {6, 6}, "<<": {7, 7}, ">>": {7, 7},
+	"..": {9, 8}, "+": {10, 10}, "-": {10, 10},
+	"*": {11, 11}, "/": {11, 11}, "//": {11, 11}, "%": {11, 11},
+	"^": {14, 13},
+}
+
+const luaUnaryPriority = 12
+
+func (p *luaParser) expr() Node { return p.subExpr(0) }
+
+func (p *luaParser) subExpr(limit int) Node {
+	var expr Node
+	line := p.tok.line
+	if p.is("not") || p.is("-") || p.is("#") || p.is("~") {
+		op := p.tok.value
+		p.next()
+		expr = &UnOp{line: line, Op: op, X: p.subExpr(luaUnaryPriority)}
+	} else {
+		expr = p.simpleExpr()
+	}
+
+	for p.tok.kind == tKeyword || p.tok.kind == tSymbol {
+		op := p.tok.value
+		priority, ok := luaBinaryPriority[op]
+		if !ok || priority[0] <= limit {
+			break
+		}
+		line := p.tok.line
+		p.next()
+		expr = &BinOp{line: line, Op: op, L: expr, R: p.subExpr(priority[1])}
+	}
+	return expr
+}
@@ -0,0 +1,289 @@
+package luaparse
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// sexpr writes a node in a compact form that is easy to compare.
+func sexpr(node Node) string {
+	list := func(nodes []Node) string {
+		s := make([]string, len(nodes))
+		for i, n := range nodes {
+			s[i] = sexpr(n)
+		}
+		return strings.Join(s, " ")
+	}
+	block := func(b *Block) string {
+		if b == nil {
+			return "()"
+		}
+		return "(" + list(b.Stats) + ")"
+	}
+
+	switch n := node.(type) {
+	case nil:
+		return "<nil>"
+	case *Nil:
+		return "nil"
+	case *True:
+		return "true"
+	case *False:
+		return "false"
+	case *Vararg:
+		return "..."
+	case *Number:
+		return n.Value
+	case *String:
+		return fmt.Sprintf("%q", n.Value)
+	case *Name:
+		return n.Name
+	case *Index:
+		return "(index " + sexpr(n.Obj) + " " + sexpr(n.Key) + ")"
+	case *Call:
+		return strings.TrimSpace("(call "+sexpr(n.Fn)+" "+list(n.Args)) + ")"
+	case *MethodCall:
+		return strings.TrimSpace("(method "+sexpr(n.Obj)+" "+n.Name+" "+list(n.Args)) + ")"
+	case *Function:
+		params := strings.Join(n.Params, " ")
+		if n.IsVararg {
+			params = strings.TrimSpace(params + " ...")
+		}
+		return "(function (" + params + ") " + block(n.Body) + ")"
+	case *Table:
+		fields := make([]string, len(n.Fields))
+		for i, f := range n.Fields {
+			if f.Key == nil {
+				fields[i] = sexpr(f.Value)
+			} else {
+				fields[i] = sexpr(f.Key) + "=" + sexpr(f.Value)
+			}
+		}
+		return strings.TrimSpace("(table "+strings.Join(fields, " ")) + ")"
+	case *BinOp:
+		return "(" + n.Op + " " + sexpr(n.L) + " " + sexpr(n.R) + ")"
+	case *UnOp:
+		return "(" + n.Op + " " + sexpr(n.X) + ")"
+	case *Paren:
+		return "(paren " + sexpr(n.X) + ")"
+	case *Local:
+		return "(local " + strings.Join(n.Names, " ") + " " + list(n.Exprs) + ")"
+	case *Assign:
+		return "(= (" + list(n.Targets) + ") " + list(n.Exprs) + ")"
+	case *CallStat:
+		return sexpr(n.Call)
+	case *Do:
+		return "(do " + block(n.Body) + ")"
+	case *While:
+		return "(while " + sexpr(n.Cond) + " " + block(n.Body) + ")"
+	case *Repeat:
+		return "(repeat " + block(n.Body) + " " + sexpr(n.Cond) + ")"
+	case *If:
+		s := "(if"
+		for i := range n.Conds {
+			s += " " + sexpr(n.Conds[i]) + " " + block(n.Blocks[i])
+		}
+		if n.Else != nil {
+			s += " else " + block(n.Else)
+		}
+		return s + ")"
+	case *NumFor:
+		return "(for " + n.Var + " " + sexpr(n.Start) + " " + sexpr(n.Limit) + " " +
+			sexpr(n.Step) + " " + block(n.Body) + ")"
+	case *GenFor:
+		return "(for (" + strings.Join(n.Names, " ") + ") (" + list(n.Exprs) + ") " +
+			block(n.Body) + ")"
+	case *FunctionStat:
+		name := strings.Join(n.Path, ".")
+		if n.Method != "" {
+			name += ":" + n.Method
+		}
+		return "(defun " + name + " " + sexpr(n.Func) + ")"
+	case *LocalFunction:
+		return "(local-defun " + n.Name + " " + sexpr(n.Func) + ")"
+	case *Return:
+		return strings.TrimSpace("(return "+list(n.Exprs)) + ")"
+	case *Break:
+		return "(break)"
+	case *Goto:
+		return "(goto " + n.Label + ")"
+	case *Label:
+		return "(label " + n.Name + ")"
+	}
+	return fmt.Sprintf("<%T>", node)
+}
+
+func TestParseExpressions(t *testing.T) {
+	for _, tc := range []struct {
+		expr     string
+		expected string
+	}{
+		{`1 + 2 * 3`, `(+ 1 (* 2 3))`},
+		{`(1 + 2) * 3`, `(* (paren (+ 1 2)) 3)`},
+		{`1 - 2 - 3`, `(- (- 1 2) 3)`},
+		{`2 ^ 3 ^ 2`, `(^ 2 (^ 3 2))`},
+		{`-x ^ 2`, `(- (^ x 2))`},
+		{`a .. b .. c`, `(.. a (.. b c))`},
+		{`"n" .. 1 + 2`, `(.. "n" (+ 1 2))`},
+		{`not a == b`, `(== (not a) b)`},
+		{`a or b and c`, `(or a (and b c))`},
+		{`a < b == c`, `(== (< a b) c)`},
+		{`1 << 2 + 3`, `(<< 1 (+ 2 3))`},
+		{`a | b ~ c & d`, `(| a (~ b (& c d)))`},
+		{`~a & b`, `(& (~ a) b)`},
+		{`x // 2 % 3`, `(% (// x 2) 3)`},
+		{`#t - 1`, `(- (# t) 1)`},
+		{`0x1F + 1e3 + .5`, `(+ (+ 0x1F 1e3) .5)`},
+		{`a.b[c].d`, `(index (index (index a "b") c) "d")`},
+		{`f(1)(2)`, `(call (call f 1) 2)`},
+		{`f "s" {1}`, `(call (call f "s") (table 1))`},
+		{`obj:m(1, 2)`, `(method obj m 1 2)`},
+		{`{1, x = 2, ["y"] = 3; 4}`, `(table 1 "x"=2 "y"=3 4)`},
+		{`{x == 1}`, `(table (== x 1))`},
+		{`function (a, ...) return ... end`, `(function (a ...) ((return ...)))`},
+		{`nil and true or false`, `(or (and nil true) false)`},
+	} {
+		block, err := Parse("x = " + tc.expr)
+		if err != nil {
+			t.Errorf("%s: %s", tc.expr, err)
+			continue
+		}
+		if got := sexpr(block.Stats[0].(*Assign).Exprs[0]); got != tc.expected {
+			t.Errorf("%s: got %s, expected %s", tc.expr, got, tc.expected)
+		}
+	}
+}
+
+func TestParseStrings(t *testing.T) {
+	for _, tc := range []struct {
+		code     string
+		expected string
+	}{
+		{`"a\tb"`, "a\tb"},
+		{`'it\'s "quoted"'`, `it's "quoted"`},
+		{`"\65\x41\u{48}\0"`, "AAH\x00"},
+		{`"a\z
+		      b"`, "ab"},
+		{`"line\
+next"`, "line\nnext"},
+		{`[[hello]]`, "hello"},
+		{`[==[a]]b]=]c]==]`, "a]]b]=]c"},
+		{"[[\nthe first newline is skipped\n]]", "the first newline is skipped\n"},
+		{"[=[\r\nwindows]=]", "windows"},
+	} {
+		block, err := Parse("x = " + tc.code)
+		if err != nil {
+			t.Errorf("%s: %s", tc.code, err)
+			continue
+		}
+		str, ok := block.Stats[0].(*Assign).Exprs[0].(*String)
+		if !ok || str.Value != tc.expected {
+			t.Errorf("%s: got %s, expected %q", tc.code, sexpr(block.Stats[0]), tc.expected)
+		}
+	}
+}
+
+func TestParseStatements(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		code     string
+		expected string
+		lines    []int
+	}{
+		{
+			"comments",
+			`--[==[ a long
+comment with ]] inside ]==]
+x = 1 -- a short one
+--[[ another ]] y = 2
+--[ not long
+z = 3`,
+			`(= (x) 1) (= (y) 2) (= (z) 3)`,
+			[]int{3, 4, 6},
+		},
+		{
+			"long string lines",
+			"x = [[\na\nb]]\ny = 2",
+			`(= (x) "a\nb") (= (y) 2)`,
+			[]int{1, 4},
+		},
+		{
+			"goto and labels",
+			`for i = 1, 3 do
+  if i == 2 then goto continue end
+  f(i)
+  ::continue::
+end
+goto done
+::done::`,
+			`(for i 1 3 <nil> ((if (== i 2) ((goto continue))) (call f i) (label continue))) (goto done) (label done)`,
+			[]int{1, 6, 7},
+		},
+		{
+			"method definitions",
+			`function a.b.c:m (x) return self end
+function a.f (...) end
+local function g () end
+h = function () end`,
+			`(defun a.b.c:m (function (self x) ((return self)))) (defun a.f (function (...) ())) (local-defun g (function () ())) (= (h) (function () ()))`,
+			[]int{1, 2, 3, 4},
+		},
+		{
+			"control flow",
+			`while x do break end
+repeat local y = 1 until y
+if a then elseif b then else end
+for k, v in pairs(t) do end
+do return end`,
+			`(while x ((break))) (repeat ((local y 1)) y) (if a () b () else ()) (for (k v) ((call pairs t)) ()) (do ((return)))`,
+			[]int{1, 2, 3, 4, 5},
+		},
+		{
+			"semicolons and multiple assignment",
+			`local a, b = 1, 2; a, t[1] = b, a;`,
+			`(local a b 1 2) (= (a (index t 1)) b a)`,
+			[]int{1, 1},
+		},
+	} {
+		block, err := Parse(tc.code)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if got := strings.TrimSuffix(strings.TrimPrefix(sexpr(&Do{Body: block}), "(do ("), "))"); got != tc.expected {
+			t.Errorf("%s:\n got %s\n expected %s", tc.name, got, tc.expected)
+		}
+		for i, stat := range block.Stats {
+			if i < len(tc.lines) && stat.Line() != tc.lines[i] {
+				t.Errorf("%s: statement %d is on line %d, expected %d",
+					tc.name, i, stat.Line(), tc.lines[i])
+			}
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tc := range []struct {
+		code     string
+		expected string
+	}{
+		{"x = = 1", "line 1: unexpected symbol near '='"},
+		{"x = 3y", "line 1: malformed number near '3y'"},
+		{"x = 'abc", "line 1: unfinished string"},
+		{"x = [[abc", "line 1: unfinished long string"},
+		{"--[[ abc\n\nx = 1", "line 1: unfinished long comment"},
+		{"if x then\n\nf()", "line 3: 'end' expected (to close 'if' at line 1) near <eof>"},
+		{"f() = 1", "line 1: syntax error, can't assign to this"},
+		{"return 1\nx = 2", "line 2: <eof> expected near 'x'"},
+		{"x = '\\q'", "line 1: invalid escape sequence '\\q'"},
+		{"x = 1 @", "line 1: unexpected symbol '@'"},
+	} {
+		_, err := Parse(tc.code)
+		if err == nil {
+			t.Errorf("%q: expected an error", tc.code)
+		} else if err.Error() != tc.expected {
+			t.Errorf("%q: got %q, expected %q", tc.code, err, tc.expected)
+		}
+	}
+}
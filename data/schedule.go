@@ -0,0 +1,105 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Schedule struct {
+	Id         string          `json:"id"`
+	ContractId string          `json:"contract_id"`
+	Method     string          `json:"method"`
+	Payload    json.RawMessage `json:"payload"`
+	Time       time.Time       `json:"time"` // when the call should run
+	Call       string          `json:"call"` // the call that has created this
+}
+
+// ScheduleId is the id of the nth call scheduled during a call. It is
+// derived from the call id so replaying the call gives the same ids.
+func ScheduleId(call string, n int) string {
+	return derivedId("s", call, n)
+}
+
+func SaveSchedule(sch Schedule) error {
+	path := filepath.Join(DatabasePath, "contracts", sch.ContractId, "schedules")
+	if err := os.MkdirAll(path, 0o700); err != nil {
+		return err
+	}
+
+	return writeJSON(filepath.Join(path, sch.Id+".json"), sch)
+}
+
+// ListSchedules returns the pending scheduled calls of a contract, the next
+// ones first.
+func ListSchedules(contract string) (schedules []Schedule, err error) {
+	path := filepath.Join(DatabasePath, "contracts", contract, "schedules")
+	entries, err := ioutil.ReadDir(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		var sch Schedule
+		if err := readJSON(filepath.Join(path, entry.Name()), &sch); err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, sch)
+	}
+
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].Time.Before(schedules[j].Time)
+	})
+
+	return schedules, nil
+}
+
+// ListDueSchedules returns the scheduled calls of all contracts that should
+// have run before the given time.
+func ListDueSchedules(now time.Time) (due []Schedule, err error) {
+	entries, err := ioutil.ReadDir(filepath.Join(DatabasePath, "contracts"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		schedules, err := ListSchedules(entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("failed to list schedules for %s: %w",
+				entry.Name(), err)
+		}
+
+		for _, sch := range schedules {
+			if sch.Time.After(now) {
+				break
+			}
+			due = append(due, sch)
+		}
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].Time.Before(due[j].Time)
+	})
+
+	return due, nil
+}
+
+func DeleteSchedule(contract string, id string) error {
+	path := filepath.Join(DatabasePath, "contracts", contract, "schedules", id+".json")
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+
+	return gitAdd(path)
+}
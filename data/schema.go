@@ -0,0 +1,175 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// methods can be annotated with comments right above them:
+//
+//   --- sends money to someone
+//   ---@param target string required the account that will get the money
+//   ---@param note string|nil
+//   ---@price 1000
+//   function send ()
+//
+// params become a JSON schema for the call payload and the price is the
+// minimum msatoshi a call must include. types can be unions like string|number,
+// which accept anything, and nil in them (or a ? at the end) means the param
+// is optional.
+
+var (
+	paramAnnRe = regexp.MustCompile(`^---\s*@param\s+([\w_]+)\s+([\w|]+\??)(?:\s+(required|optional))?(?:\s+(.*))?$`)
+	priceAnnRe = regexp.MustCompile(`^---\s*@price\s+(\d+)\s*$`)
+	tagAnnRe   = regexp.MustCompile(`^---\s*@(\w*)`)
+)
+
+var schemaTypes = map[string]string{
+	"any":     "",
+	"string":  "string",
+	"number":  "number",
+	"integer": "integer",
+	"boolean": "boolean",
+	"table":   "object",
+	"object":  "object",
+	"array":   "array",
+}
+
+// Schema is the JSON schema of a method payload.
+type Schema struct {
+	Type       string              `json:"type"`
+	Properties map[string]Property `json:"properties"`
+	Required   []string            `json:"required,omitempty"`
+}
+
+type Property struct {
+	Type        string `json:"type,omitempty"` // blank means anything
+	Description string `json:"description,omitempty"`
+}
+
+// parseAnnotations applies the annotation lines to the method, it returns an
+// error for the first @param or @price it doesn't understand. other tags,
+// like the @return and @see used by editors, are ignored.
+func parseAnnotations(method *Method, lines []string) error {
+	var description []string
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+
+		if matches := paramAnnRe.FindStringSubmatch(line); len(matches) == 5 {
+			typ, nilable, err := parseParamType(matches[2])
+			if err != nil {
+				return fmt.Errorf("%w for param '%s'", err, matches[1])
+			}
+			if nilable && matches[3] == "required" {
+				return fmt.Errorf("param '%s' can't be required and nil", matches[1])
+			}
+
+			if method.Schema == nil {
+				method.Schema = &Schema{
+					Type:       "object",
+					Properties: make(map[string]Property),
+				}
+			}
+			method.Schema.Properties[matches[1]] = Property{
+				Type:        typ,
+				Description: matches[4],
+			}
+			if matches[3] == "required" {
+				method.Schema.Required = append(method.Schema.Required, matches[1])
+			}
+		} else if matches := priceAnnRe.FindStringSubmatch(line); len(matches) == 2 {
+			method.Price, _ = strconv.ParseInt(matches[1], 10, 64)
+		} else if matches := tagAnnRe.FindStringSubmatch(line); len(matches) == 2 {
+			if matches[1] == "param" || matches[1] == "price" {
+				return fmt.Errorf("invalid annotation '%s'", line)
+			}
+		} else if text := strings.TrimSpace(line[3:]); text != "" {
+			description = append(description, text)
+		}
+	}
+
+	method.Description = strings.Join(description, " ")
+	return nil
+}
+
+// parseParamType returns the schema type for an annotated type and if it
+// allows nil.
+func parseParamType(annotated string) (typ string, nilable bool, err error) {
+	if strings.HasSuffix(annotated, "?") {
+		nilable = true
+		annotated = strings.TrimSuffix(annotated, "?")
+	}
+
+	var types []string
+	for _, name := range strings.Split(annotated, "|") {
+		if name == "nil" {
+			nilable = true
+			continue
+		}
+		t, ok := schemaTypes[name]
+		if !ok {
+			return "", false, fmt.Errorf("unknown type '%s'", name)
+		}
+		if len(types) == 0 || types[0] != t {
+			types = append(types, t)
+		}
+	}
+
+	switch len(types) {
+	case 0:
+		return "", false, fmt.Errorf("type can't be just nil")
+	case 1:
+		return types[0], nilable, nil
+	default:
+		// only one type fits in the schema
+		return "", nilable, nil
+	}
+}
+
+// Validate checks a call payload against the schema.
+func (s *Schema) Validate(payload json.RawMessage) error {
+	var values map[string]interface{}
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &values); err != nil {
+			return fmt.Errorf("payload must be an object")
+		}
+	}
+
+	for _, name := range s.Required {
+		if v, ok := values[name]; !ok || v == nil {
+			return fmt.Errorf("missing required param '%s'", name)
+		}
+	}
+
+	for name, value := range values {
+		prop, ok := s.Properties[name]
+		if !ok || prop.Type == "" || value == nil {
+			continue
+		}
+		if !hasSchemaType(value, prop.Type) {
+			return fmt.Errorf("param '%s' must be of type %s", name, prop.Type)
+		}
+	}
+
+	return nil
+}
+
+func hasSchemaType(value interface{}, typ string) bool {
+	switch v := value.(type) {
+	case string:
+		return typ == "string"
+	case bool:
+		return typ == "boolean"
+	case float64:
+		return typ == "number" || (typ == "integer" && v == math.Trunc(v))
+	case map[string]interface{}:
+		return typ == "object"
+	case []interface{}:
+		return typ == "array"
+	}
+	return false
+}
@@ -0,0 +1,205 @@
+package data
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestAnnotations(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		code     string
+		expected Method
+		err      string
+	}{
+		{
+			"description, params and price",
+			`
+--- buys a ticket
+--- for the next draw
+---@param numbers array required the chosen numbers
+---@param nickname string
+---@param extra any optional
+---@price 100000
+function buy ()
+end`,
+			Method{
+				Name:        "buy",
+				Params:      []string{"extra", "nickname", "numbers"},
+				Description: "buys a ticket for the next draw",
+				Price:       100000,
+				Schema: &Schema{
+					Type: "object",
+					Properties: map[string]Property{
+						"numbers":  {Type: "array", Description: "the chosen numbers"},
+						"nickname": {Type: "string"},
+						"extra":    {},
+					},
+					Required: []string{"numbers"},
+				},
+			},
+			"",
+		},
+		{
+			"other tags are ignored",
+			`
+--- the balance of someone
+---@param user string required
+---@return integer
+---@see transfer
+balance = function ()
+  return account.id, call.payload.user, call.payload.token
+end`,
+			Method{
+				Name:        "balance",
+				Params:      []string{"token", "user"},
+				Auth:        true,
+				Description: "the balance of someone",
+				Schema: &Schema{
+					Type:       "object",
+					Properties: map[string]Property{"user": {Type: "string"}},
+					Required:   []string{"user"},
+				},
+			},
+			"",
+		},
+		{
+			"plain comments separated by a blank line don't count",
+			`
+-- not an annotation
+---@param x string
+
+function f ()
+end`,
+			Method{Name: "f", Params: []string{}},
+			"",
+		},
+		{
+			"union types",
+			`
+---@param note string|nil
+---@param amount number?
+---@param id string|integer required
+---@param opts table|object|nil
+function f ()
+end`,
+			Method{
+				Name:   "f",
+				Params: []string{"amount", "id", "note", "opts"},
+				Schema: &Schema{
+					Type: "object",
+					Properties: map[string]Property{
+						"note":   {Type: "string"},
+						"amount": {Type: "number"},
+						"id":     {},
+						"opts":   {Type: "object"},
+					},
+					Required: []string{"id"},
+				},
+			},
+			"",
+		},
+		{
+			"required nil",
+			`
+---@param note string|nil required
+function f ()
+end`,
+			Method{},
+			"method f (line 4): param 'note' can't be required and nil",
+		},
+		{
+			"unknown type in a union",
+			`
+---@param x string|float
+function f ()
+end`,
+			Method{},
+			"method f (line 4): unknown type 'float' for param 'x'",
+		},
+		{
+			"unknown type",
+			`
+---@param x float
+function f ()
+end`,
+			Method{},
+			"method f (line 4): unknown type 'float' for param 'x'",
+		},
+		{
+			"malformed price",
+			`
+---@price lots
+function f ()
+end`,
+			Method{},
+			"method f (line 4): invalid annotation '---@price lots'",
+		},
+	} {
+		ct := &Contract{Code: "function __init__ () return {} end\n" + tc.code}
+		_, err := parseContractCode(ct, true)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: got error %v, expected %s", tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+
+		method := ct.GetMethod(tc.expected.Name)
+		if method == nil {
+			t.Errorf("%s: method %s not found", tc.name, tc.expected.Name)
+			continue
+		}
+		if !reflect.DeepEqual(*method, tc.expected) {
+			got, _ := json.Marshal(method)
+			expected, _ := json.Marshal(tc.expected)
+			t.Errorf("%s:\n got %s\n expected %s", tc.name, got, expected)
+		}
+	}
+}
+
+func TestStoredContractAnnotations(t *testing.T) {
+	code := `
+function __init__ ()
+  return {}
+end
+
+---@param x float
+function withdraw ()
+  return account.id
+end
+
+b, a = function () end, function () end
+`
+
+	// new contracts are refused
+	if _, err := parseContractCode(&Contract{Code: code}, true); err == nil {
+		t.Fatal("the invalid annotation should have been refused")
+	}
+
+	// contracts already deployed keep their methods
+	ct := &Contract{Code: code}
+	ignored, err := parseContractCode(ct, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ignored) != 1 {
+		t.Errorf("got %d ignored annotations, expected 1: %v", len(ignored), ignored)
+	}
+
+	var names []string
+	for _, method := range ct.Methods {
+		names = append(names, method.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"withdraw", "a", "b"}) {
+		t.Errorf("got methods %v, expected [withdraw a b]", names)
+	}
+	if withdraw := ct.GetMethod("withdraw"); withdraw == nil || !withdraw.Auth || withdraw.Schema != nil {
+		t.Errorf("withdraw should require auth and have no schema, got %+v", withdraw)
+	}
+}
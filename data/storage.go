@@ -0,0 +1,110 @@
+package data
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// contract storage lives in one file per key, so calls only touch the keys
+// they use instead of the full state.
+
+// StorageKeyFile is the name of the file where a storage key is saved.
+func StorageKeyFile(key string) string {
+	return url.PathEscape(key) + ".json"
+}
+
+func storageKeyFromFile(name string) (string, bool) {
+	if !strings.HasSuffix(name, ".json") {
+		return "", false
+	}
+	key, err := url.PathUnescape(strings.TrimSuffix(name, ".json"))
+	if err != nil {
+		return "", false
+	}
+	return key, true
+}
+
+// GetStorage returns the value saved under a key, or nil if there is none.
+func GetStorage(contract string, key string) (value json.RawMessage, err error) {
+	err = readJSON(
+		filepath.Join(DatabasePath, "contracts", contract, "storage", StorageKeyFile(key)),
+		&value,
+	)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return value, err
+}
+
+func SaveStorage(contract string, key string, value json.RawMessage) error {
+	path := filepath.Join(DatabasePath, "contracts", contract, "storage")
+	if err := os.MkdirAll(path, 0o700); err != nil {
+		return err
+	}
+
+	return writeJSON(filepath.Join(path, StorageKeyFile(key)), value)
+}
+
+func DeleteStorage(contract string, key string) error {
+	path := filepath.Join(DatabasePath, "contracts", contract, "storage", StorageKeyFile(key))
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return gitAdd(path)
+}
+
+// ListStorageKeys returns, sorted, all the keys that start with prefix.
+func ListStorageKeys(contract string, prefix string) (keys []string, err error) {
+	entries, err := ioutil.ReadDir(
+		filepath.Join(DatabasePath, "contracts", contract, "storage"))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+	}
+	return filterStorageKeys(names, prefix), nil
+}
+
+// ListStorageKeysAt is like ListStorageKeys, but at a commit.
+func ListStorageKeysAt(commit string, contract string, prefix string) ([]string, error) {
+	out, err := gitOutput("ls-tree", "--name-only", commit,
+		path.Join("contracts", contract, "storage")+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		if line != "" {
+			names = append(names, path.Base(line))
+		}
+	}
+	return filterStorageKeys(names, prefix), nil
+}
+
+func filterStorageKeys(names []string, prefix string) []string {
+	keys := make([]string, 0, len(names))
+	for _, name := range names {
+		if key, ok := storageKeyFromFile(name); ok && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
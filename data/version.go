@@ -0,0 +1,125 @@
+package data
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// a contract starts at version 1 and each upgrade adds one. the code of the
+// previous versions is kept at versions/<version>.lua, contract.lua always has
+// the current one.
+
+type Version struct {
+	Version  int       `json:"version"`
+	CodeHash string    `json:"code_hash"`
+	Time     time.Time `json:"time"`
+	Call     string    `json:"call,omitempty"` // the call that installed it
+	Code     string    `json:"code,omitempty"`
+}
+
+// ListVersions returns all the versions of the contract code. contracts
+// created before we had versions just have the first.
+func ListVersions(contract string) (versions []Version, err error) {
+	path := filepath.Join(DatabasePath, "contracts", contract)
+	err = readJSON(filepath.Join(path, "versions.json"), &versions)
+	if err == nil {
+		return versions, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	code, err := ioutil.ReadFile(filepath.Join(path, "contract.lua"))
+	if err != nil {
+		return nil, err
+	}
+	return []Version{{
+		Version:  1,
+		CodeHash: CodeHash(string(code)),
+		Time:     gitGetLastCommitFileTimestamp(filepath.Join(path, "name.txt")),
+		Call:     contract,
+	}}, nil
+}
+
+// GetVersion returns a version of the contract, with its code.
+func GetVersion(contract string, version int) (*Version, error) {
+	versions, err := ListVersions(contract)
+	if err != nil {
+		return nil, err
+	}
+	if version < 1 || version > len(versions) {
+		return nil, nil
+	}
+
+	v := versions[version-1]
+	name := filepath.Join("versions", strconv.Itoa(version)+".lua")
+	if version == len(versions) {
+		name = "contract.lua"
+	}
+	code, err := ioutil.ReadFile(filepath.Join(DatabasePath, "contracts", contract, name))
+	if err != nil {
+		return nil, err
+	}
+	v.Code = string(code)
+	return &v, nil
+}
+
+// UpgradeContract replaces the contract code, keeping the previous one, and
+// returns the new version number.
+func UpgradeContract(
+	id string,
+	code string,
+	libraries map[string]string,
+	call string,
+) (version int, err error) {
+	versions, err := ListVersions(id)
+	if err != nil {
+		return 0, err
+	}
+
+	path := filepath.Join(DatabasePath, "contracts", id)
+	previous, err := ioutil.ReadFile(filepath.Join(path, "contract.lua"))
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.MkdirAll(filepath.Join(path, "versions"), 0o700); err != nil {
+		return 0, err
+	}
+	if err := writeFile(
+		filepath.Join(path, "versions", strconv.Itoa(len(versions))+".lua"),
+		previous,
+	); err != nil {
+		return 0, err
+	}
+	if err := writeFile(filepath.Join(path, "contract.lua"), []byte(code)); err != nil {
+		return 0, err
+	}
+
+	if len(libraries) > 0 {
+		err = writeJSON(filepath.Join(path, "libraries.json"), libraries)
+	} else if err = os.Remove(filepath.Join(path, "libraries.json")); err == nil {
+		err = gitAdd(filepath.Join(path, "libraries.json"))
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	version = len(versions) + 1
+	versions = append(versions, Version{
+		Version:  version,
+		CodeHash: CodeHash(code),
+		Time:     time.Now(),
+		Call:     call,
+	})
+	if err := writeJSON(filepath.Join(path, "versions.json"), versions); err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
@@ -8,9 +8,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"image/png"
+	"net"
 	"net/http"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/fiatjaf/hashbow"
@@ -42,6 +44,34 @@ func jsonError(w http.ResponseWriter, message string, code int) {
 	})
 }
 
+var trustedProxies hostPolicy
+
+// rateLimited counts the requests of the given kind made by the same IP address
+// in the current minute and tells if they're above the limit.
+func rateLimited(kind string, r *http.Request, perMinute int64) bool {
+	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+	// behind our own proxy the address is the last one it has added
+	if remote := net.ParseIP(ip); remote != nil && trustedProxies.matchesIP(remote) {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			addresses := strings.Split(forwarded, ",")
+			ip = strings.TrimSpace(addresses[len(addresses)-1])
+		}
+	}
+
+	key := "ratelimit:" + kind + ":" + ip
+	n, err := rds.Incr(key).Result()
+	if err != nil {
+		log.Warn().Err(err).Str("key", key).Msg("failed to increment rate limit")
+		return false
+	}
+	if n == 1 {
+		rds.Expire(key, time.Minute)
+	}
+
+	return n > perMinute
+}
+
 func diffDeltaOneliner(prefix string, idelta gojsondiff.Delta) (lines []string) {
 	key := prefix
 	if key != "" {
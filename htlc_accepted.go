@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
@@ -170,7 +171,8 @@ func contractPaymentReceived(contractId string, msatoshi int64) (ok bool) {
 	data.Start()
 
 	// create initial contract
-	err = data.CreateContract(ct.Id, ct.Name, ct.Readme, ct.Code)
+	err = data.CreateContract(ct.Id, ct.Name, ct.Readme, ct.Code,
+		ct.Owner, ct.Library, ct.Libraries)
 	if err != nil {
 		logger.Warn().Err(err).Msg("failed to save contract on database")
 		data.Abort()
@@ -179,6 +181,16 @@ func contractPaymentReceived(contractId string, msatoshi int64) (ok bool) {
 		return false
 	}
 
+	// libraries have nothing to initialize
+	if ct.Library {
+		data.Finish("library " + ct.Id + " created.")
+		dispatchContractEvent(contractId,
+			ctevent{contractId, "", "", 0, "", ""}, "contract-created")
+		logger.Info().Msg("library is live")
+		rds.Del("contract:" + contractId)
+		return true
+	}
+
 	// instantiate call (the __init__ special kind)
 	call := &data.Call{
 		ContractId: ct.Id,
@@ -188,7 +200,7 @@ func contractPaymentReceived(contractId string, msatoshi int64) (ok bool) {
 		Cost:       getContractCost(*ct),
 	}
 
-	err = runCallGlobal(call, false)
+	err = runCallGlobal(context.Background(), call, false)
 	if err != nil {
 		logger.Warn().Err(err).Msg("failed to run call")
 		data.Abort()
@@ -234,7 +246,7 @@ func callPaymentReceived(callId string, msatoshi int64) (ok bool) {
 	logger.Info().Interface("call", call).Msg("call being made")
 
 	// a normal call
-	err = runCallGlobal(call, false)
+	err = runCallGlobal(context.Background(), call, false)
 	if err != nil {
 		logger.Warn().Err(err).Msg("failed to run call")
 		data.Abort()
@@ -248,7 +260,10 @@ func callPaymentReceived(callId string, msatoshi int64) (ok bool) {
 	data.Finish(call.Method + " " + call.Id + " executed on contract " + call.ContractId + ".")
 
 	dispatchContractEvent(call.ContractId,
-		ctevent{callId, call.ContractId, call.Method, call.Msatoshi, "", ""}, "call-made")
+		callmadeevent{
+			ctevent{callId, call.ContractId, call.Method, call.Msatoshi, "", ""},
+			call.Result,
+		}, "call-made")
 
 	// saved. delete from redis.
 	rds.Del("call:" + call.Id)
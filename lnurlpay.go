@@ -9,6 +9,7 @@ import (
 	_ "image/png"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/fiatjaf/etleneum/data"
 	"github.com/fiatjaf/go-lnurl"
@@ -17,6 +18,9 @@ import (
 	"github.com/tidwall/gjson"
 )
 
+// lnurls made on behalf of an account can't be valid for longer than this.
+const maxLnurlCallAge = 24 * time.Hour
+
 func lnurlCallMetadata(call *data.Call, fixedAmount bool) string {
 	desc := fmt.Sprintf(`Call method "%s" on contract "%s" with payload %s`,
 		call.Method, call.ContractId, string(call.Payload))
@@ -104,17 +108,41 @@ func lnurlPayParams(w http.ResponseWriter, r *http.Request) {
 	// if the user has hmac'ed this call we set them as the caller
 	if account := qs.Get("_account"); account != "" {
 		mac, _ := hex.DecodeString(qs.Get("_hmac"))
+		nonce := qs.Get("_nonce")
+		expiry, _ := strconv.ParseInt(qs.Get("_expiry"), 10, 64)
 		call.Caller = account // assume correct
 
 		// then verify
-		if !hmac.Equal(mac, hmacCall(call)) {
+		if !hmac.Equal(mac, hmacCall(call, nonce, expiry)) {
 			logger.Warn().Str("hmac", hex.EncodeToString(mac)).
-				Str("expected", hex.EncodeToString(hmacCall(call))).
-				Str("serialized", callHmacString(call)).
+				Str("expected", hex.EncodeToString(hmacCall(call, nonce, expiry))).
+				Str("serialized", callHmacString(call, nonce, expiry)).
 				Msg("hmac mismatch")
 			json.NewEncoder(w).Encode(lnurl.ErrorResponse("Invalid HMAC."))
 			return
 		}
+
+		// anyone who sees the lnurl could otherwise pay it again and again,
+		// spending from the account each time
+		ttl := time.Until(time.Unix(expiry, 0))
+		if nonce == "" || ttl <= 0 {
+			json.NewEncoder(w).Encode(lnurl.ErrorResponse("This lnurl has expired."))
+			return
+		}
+		if ttl > maxLnurlCallAge {
+			json.NewEncoder(w).Encode(lnurl.ErrorResponse("Expiry is too far in the future."))
+			return
+		}
+		fresh, err := rds.SetNX("lnurl-nonce:"+account+":"+nonce, call.Id, ttl).Result()
+		if err != nil {
+			logger.Error().Err(err).Msg("failed to save lnurl nonce on redis")
+			json.NewEncoder(w).Encode(lnurl.ErrorResponse("Failed to save call data."))
+			return
+		}
+		if !fresh {
+			json.NewEncoder(w).Encode(lnurl.ErrorResponse("This lnurl was already used."))
+			return
+		}
 	}
 
 	logger = logger.With().Str("callid", call.Id).Logger()
@@ -126,6 +154,18 @@ func lnurlPayParams(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	annotated, err := checkCallPayload(call)
+	if err != nil {
+		logger.Warn().Err(err).Str("payload", string(call.Payload)).
+			Msg("invalid payload")
+		json.NewEncoder(w).Encode(lnurl.ErrorResponse("Invalid call: " + err.Error() + "."))
+		return
+	}
+	var price int64
+	if annotated != nil {
+		price = annotated.Price
+	}
+
 	_, err = saveCallOnRedis(*call)
 	if err != nil {
 		logger.Error().Err(err).Interface("call", call).
@@ -140,8 +180,17 @@ func lnurlPayParams(w http.ResponseWriter, r *http.Request) {
 		// if amount is not given let the person choose on lnurl-pay UI
 		min = defaultMinSendable
 		max = defaultMaxSendable
+		if min < price {
+			min = price
+		}
 		encodedMetadata = lnurlCallMetadata(call, false)
 	} else {
+		if call.Msatoshi < price {
+			json.NewEncoder(w).Encode(lnurl.ErrorResponse(fmt.Sprintf(
+				"%s requires at least %d msatoshi.", call.Method, price)))
+			return
+		}
+
 		// otherwise make the lnurl params be the full main_price + cost
 		min = call.Msatoshi + call.Cost
 		max = call.Msatoshi + call.Cost
@@ -178,6 +227,13 @@ func lnurlPayValues(w http.ResponseWriter, r *http.Request) {
 	//   and the user has chosen them in the wallet (i.e., they were not hardcoded
 	//   in the lnurl itself.
 	if call.Msatoshi == 0 && msatoshi != (call.Msatoshi+call.Cost) {
+		// the price was only checked on the first step
+		if method, _ := checkCallPayload(call); method != nil && msatoshi < method.Price {
+			json.NewEncoder(w).Encode(lnurl.ErrorResponse(fmt.Sprintf(
+				"%s requires at least %d msatoshi.", call.Method, method.Price)))
+			return
+		}
+
 		// to make the lnurl wallet happy, we'll generate an invoice for
 		//   the exact msatoshi amount chosen in the screen, costs will be
 		//   appended as fees in the last hop shadow channel.
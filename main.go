@@ -17,6 +17,7 @@ import (
 	"time"
 
 	"github.com/fiatjaf/etleneum/data"
+	"github.com/fiatjaf/etleneum/runlua"
 	lightning "github.com/fiatjaf/lightningd-gjson-rpc"
 	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
 	"github.com/gorilla/mux"
@@ -38,6 +39,25 @@ type Settings struct {
 
 	InitialContractCostSatoshis int64 `envconfig:"INITIAL_CONTRACT_COST_SATOSHIS" default:"970"`
 	FixedCallCostSatoshis       int64 `envconfig:"FIXED_CALL_COST_SATOSHIS" default:"1"`
+	CallGasLimit                int64 `envconfig:"CALL_GAS_LIMIT" default:"10000000"`
+	CallMemoryLimitMB           int64 `envconfig:"CALL_MEMORY_LIMIT_MB" default:"64"`
+	CallMaxDepth                int   `envconfig:"CALL_MAX_DEPTH" default:"8"` // of calls to other contracts
+	MillionGasCostSatoshis      int64 `envconfig:"MILLION_GAS_COST_SATOSHIS" default:"0"`
+	QueryRateLimit              int64 `envconfig:"QUERY_RATE_LIMIT" default:"30"` // per minute per IP
+	QueryGasLimit               int64 `envconfig:"QUERY_GAS_LIMIT" default:"1000000"`
+	QueryMaxConcurrent          int   `envconfig:"QUERY_MAX_CONCURRENT" default:"4"` // across all IPs
+
+	// ips/cidrs of the proxies we run behind, only these can set X-Forwarded-For
+	TrustedProxies []string `envconfig:"TRUSTED_PROXIES"`
+
+	// http calls made by contracts. hosts in the allowlist also match their
+	// subdomains, if it is set only these hosts can be reached. private and
+	// loopback addresses can only be reached if their ip/cidr is allowed.
+	ContractHTTPAllow         []string `envconfig:"CONTRACT_HTTP_ALLOW"`
+	ContractHTTPDeny          []string `envconfig:"CONTRACT_HTTP_DENY"`
+	ContractHTTPMaxRequests   int      `envconfig:"CONTRACT_HTTP_MAX_REQUESTS" default:"10"` // per call
+	ContractHTTPMaxResponseKB int64    `envconfig:"CONTRACT_HTTP_MAX_RESPONSE_KB" default:"512"`
+	RecordedHTTPBodyKB        int64    `envconfig:"RECORDED_HTTP_BODY_KB" default:"64"` // saved with each call
 
 	NodeId   string
 	FreeMode bool
@@ -139,6 +159,17 @@ func server() {
 	// initialize
 	data.Initialize()
 
+	// lua limits
+	runlua.MaxGasLimit = s.CallGasLimit
+	runlua.MemoryLimit = s.CallMemoryLimitMB << 20
+
+	// contract http calls
+	runlua.MaxHTTPRequests = s.ContractHTTPMaxRequests
+	runlua.MaxHTTPResponseSize = s.ContractHTTPMaxResponseKB << 10
+	setupContractHTTP()
+	trustedProxies = parseHostPolicy(s.TrustedProxies)
+	querySlots = make(chan struct{}, s.QueryMaxConcurrent)
+
 	// redis connection
 	rurl, _ := url.Parse(s.RedisURL)
 	pw, _ := rurl.User.Password()
@@ -151,6 +182,9 @@ func server() {
 			Msg("failed to connect to redis")
 	}
 
+	// run scheduled calls when they're due
+	startScheduler()
+
 	// http server
 	router := mux.NewRouter()
 	router.PathPrefix("/static/").Handler(http.FileServer(http.FS(static)))
@@ -170,10 +204,21 @@ func server() {
 	router.Path("/~/contract/{ctid}/state").Methods("POST").HandlerFunc(getContractState)
 	router.Path("/~/contract/{ctid}/state/{jq}").Methods("GET").HandlerFunc(getContractState)
 	router.Path("/~/contract/{ctid}/funds").Methods("GET").HandlerFunc(getContractFunds)
+	router.Path("/~/contract/{ctid}/events").Methods("GET").HandlerFunc(getContractEvents)
+	router.Path("/~/contract/{ctid}/schedules").Methods("GET").HandlerFunc(getContractSchedules)
+	router.Path("/~/contract/{ctid}/storage").Methods("GET").HandlerFunc(getContractStorageKeys)
+	router.Path("/~/contract/{ctid}/storage/{key:.+}").Methods("GET").HandlerFunc(getContractStorageValue)
+	router.Path("/~/contract/{ctid}/versions").Methods("GET").HandlerFunc(getContractVersions)
+	router.Path("/~/contract/{ctid}/versions/{version:[0-9]+}").Methods("GET").HandlerFunc(getContractVersion)
+	router.Path("/~/contract/{ctid}/upgrade").Methods("POST").HandlerFunc(upgradeContract)
+	router.Path("/~/contract/{ctid}/owner").Methods("POST").HandlerFunc(transferContractOwnership)
 	router.Path("/~/contract/{ctid}").Methods("DELETE").HandlerFunc(deleteContract)
 	router.Path("/~/contract/{ctid}/call").Methods("POST").HandlerFunc(prepareCall)
 	router.Path("/~/contract/{ctid}/call/{callid}").Methods("GET").HandlerFunc(getCall)
 	router.Path("/~/contract/{ctid}/call/{callid}").Methods("PATCH").HandlerFunc(patchCall)
+	router.Path("/~/contract/{ctid}/call/{callid}/tree").Methods("GET").HandlerFunc(getCallTree)
+	router.Path("/~/contract/{ctid}/query/{method}").Methods("GET").HandlerFunc(queryContract)
+	router.Path("/~/contract/{ctid}/query/{method}").Methods("POST").HandlerFunc(queryContract)
 	router.Path("/~~~/contract/{ctid}").Methods("GET").HandlerFunc(contractStream)
 	router.Path("/lnurl/contract/{ctid}/call/{method}/{msatoshi}").
 		Methods("GET").HandlerFunc(lnurlPayParams)
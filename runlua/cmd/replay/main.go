@@ -0,0 +1,694 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/fiatjaf/etleneum/data"
+	"github.com/fiatjaf/etleneum/runlua"
+	"github.com/rs/zerolog"
+	"gopkg.in/urfave/cli.v1"
+)
+
+var (
+	devNull = os.NewFile(uintptr(syscall.Stderr), "/dev/null")
+	log     = zerolog.New(devNull).Output(zerolog.ConsoleWriter{Out: devNull})
+)
+
+func main() {
+	app := cli.NewApp()
+	app.ErrWriter = os.Stderr
+	app.Writer = os.Stdout
+	app.Name = "replay"
+	app.Usage = "Re-execute all the calls of Etleneum contracts from the git database history and check the results."
+	app.ArgsUsage = "[contract ids...]"
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "db",
+			Value: ".",
+			Usage: "Path to the git database.",
+		},
+		cli.Int64Flag{
+			Name:  "gas",
+			Value: runlua.MaxGasLimit,
+			Usage: "Maximum gas each call is allowed to use.",
+		},
+		cli.Int64Flag{
+			Name:  "memory",
+			Value: runlua.MemoryLimit >> 20,
+			Usage: "Maximum memory each call is allowed to use (in megabytes).",
+		},
+	}
+	app.Action = func(c *cli.Context) error {
+		data.DatabasePath, _ = filepath.Abs(c.String("db"))
+		runlua.MaxGasLimit = c.Int64("gas")
+		runlua.MemoryLimit = c.Int64("memory") << 20
+
+		ids := []string(c.Args())
+		if len(ids) == 0 {
+			entries, err := ioutil.ReadDir(filepath.Join(data.DatabasePath, "contracts"))
+			if err != nil {
+				fmt.Fprintf(app.ErrWriter, "failed to list contracts: %s\n", err)
+				os.Exit(1)
+			}
+			for _, entry := range entries {
+				if entry.IsDir() {
+					ids = append(ids, entry.Name())
+				}
+			}
+		}
+
+		failed := false
+		for _, id := range ids {
+			ncalls, err := replayContract(id)
+			if err != nil {
+				failed = true
+				fmt.Fprintf(app.Writer, "%s: %s\n", id, err)
+				continue
+			}
+			fmt.Fprintf(app.Writer, "%s: %d calls replayed, ok\n", id, ncalls)
+		}
+
+		if failed {
+			os.Exit(3)
+		}
+		return nil
+	}
+
+	app.Run(os.Args)
+}
+
+// replayContract goes through all the commits that have touched a contract,
+// re-executing every call made to it and checking if the state, funds and
+// results match what was committed.
+func replayContract(id string) (ncalls int, err error) {
+	commits, err := data.ContractHistory(id)
+	if err != nil {
+		return 0, err
+	}
+
+	base := path.Join("contracts", id)
+	for i, commit := range commits {
+		// the state before this commit. the first commit is the one that has
+		// created the contract, so there is nothing before it.
+		state := json.RawMessage("{}")
+		var funds int64
+		if i > 0 {
+			if err := data.ReadJSONAt(commit.Hash+"^", path.Join(base, "state.json"), &state); err != nil {
+				return ncalls, fmt.Errorf("failed to read state before %s: %w", commit.Hash, err)
+			}
+			data.ReadJSONAt(commit.Hash+"^", path.Join(base, "funds.json"), &funds)
+		}
+
+		// the state after
+		var stateAfter json.RawMessage
+		var fundsAfter int64
+		if err := data.ReadJSONAt(commit.Hash, path.Join(base, "state.json"), &stateAfter); err != nil {
+			// contract was deleted
+			return ncalls, nil
+		}
+		data.ReadJSONAt(commit.Hash, path.Join(base, "funds.json"), &fundsAfter)
+
+		// all the transfers made in this commit, by any contract
+		var transfers []data.Transfer
+		transferFiles, err := data.FilesAddedAt(commit.Hash, "contracts")
+		if err != nil {
+			return ncalls, err
+		}
+		for _, file := range transferFiles {
+			if path.Base(file) != "transfers.csv" {
+				continue
+			}
+			csv, err := data.ReadFileAt(commit.Hash, file)
+			if err != nil {
+				return ncalls, err
+			}
+			transfers = append(transfers, data.ParseTransfers(csv)...)
+		}
+
+		// the msatoshi included in the calls, from the caller or the invoice,
+		// plus what accounts have sent with account.send. calls made to other
+		// contracts didn't use to have their own transfers.csv, for these the
+		// call msatoshi is this.
+		var msatoshi int64
+		for _, transfer := range transfers {
+			if transfer.To == id && (transfer.From == "" || transfer.From[0] != 'c') {
+				msatoshi += transfer.Msatoshi
+			}
+		}
+
+		callFiles, err := data.FilesAddedAt(commit.Hash, path.Join(base, "calls"))
+		if err != nil {
+			return ncalls, err
+		}
+		var callIds []string
+		for _, file := range callFiles {
+			if path.Base(file) == "method.txt" {
+				callIds = append(callIds, path.Base(path.Dir(file)))
+			}
+		}
+		// a contract may be called many times in the same chain, sub-call
+		// ids tell the order in which that happened
+		sort.Slice(callIds, func(i, j int) bool {
+			return callIdLess(callIds[i], callIds[j])
+		})
+
+		var subcalled int64 // paid by other contracts to call this one
+		chainTransfers := false
+
+		// calls see the changes made by the calls before them in the same
+		// chain, so whole chains are replayed starting from their first call
+		ch := newChain(commit)
+		ch.states[id] = state
+		ch.funds[id] = funds
+		ch.prepare = func(call *data.Call) {
+			if call.ContractId != id {
+				return
+			}
+			if call.Transfers == nil {
+				chainTransfers = true
+				call.Msatoshi = msatoshi
+			}
+			if call.Parent != nil {
+				subcalled += 1000 + call.Msatoshi
+			}
+		}
+		for _, callId := range callIds {
+			if ch.done[id+"/"+callId] {
+				continue
+			}
+			root, err := ch.root(id, callId)
+			if err != nil {
+				return ncalls, err
+			}
+			if err := ch.replay(root); err != nil {
+				return ncalls, err
+			}
+		}
+		state = ch.states[id]
+		funds = ch.funds[id]
+		storage := ch.storage(id)
+		ncalls += ch.replayed[id]
+
+		funds += msatoshi - subcalled
+		for t, transfer := range transfers {
+			switch {
+			case transfer.To == id && transfer.From != "" && transfer.From[0] == 'c':
+				// an external call is recorded as a payment from the caller
+				// followed by the call msatoshi, which was already counted
+				if chainTransfers && t+1 < len(transfers) &&
+					transfers[t+1].From == "" && transfers[t+1].To == id {
+					continue
+				}
+				funds += transfer.Msatoshi
+			case transfer.From == id && transfer.To == "":
+				// the cost of a call scheduled by the contract
+				funds -= transfer.Msatoshi
+			}
+		}
+
+		if err := checkStorage(commit, id, storage); err != nil {
+			return ncalls, fmt.Errorf("diverged at commit %s (%s): %w",
+				commit.Hash, commit.Message, err)
+		}
+		if !jsonEqual(state, stateAfter) {
+			return ncalls, fmt.Errorf("diverged at commit %s (%s): state is %s, committed was %s",
+				commit.Hash, commit.Message, state, stateAfter)
+		}
+		if funds != fundsAfter {
+			return ncalls, fmt.Errorf("diverged at commit %s (%s): funds are %d, committed were %d",
+				commit.Hash, commit.Message, funds, fundsAfter)
+		}
+	}
+
+	return ncalls, nil
+}
+
+// chain holds what the calls of a commit have changed so far, as each call
+// sees the changes made by the calls before it.
+type chain struct {
+	commit   data.Commit
+	states   map[string]json.RawMessage
+	funds    map[string]int64
+	storages map[string]map[string]json.RawMessage // changed keys, nil when deleted
+	done     map[string]bool                       // contract/call
+	replayed map[string]int                        // calls per contract
+	prepare  func(*data.Call)                      // called before each call is replayed
+
+	// a divergence in a sub-call, kept here as contracts can catch errors
+	diverged error
+}
+
+func newChain(commit data.Commit) *chain {
+	return &chain{
+		commit:   commit,
+		states:   make(map[string]json.RawMessage),
+		funds:    make(map[string]int64),
+		storages: make(map[string]map[string]json.RawMessage),
+		done:     make(map[string]bool),
+		replayed: make(map[string]int),
+		prepare:  func(*data.Call) {},
+	}
+}
+
+// root finds the first call of the chain a call belongs to.
+func (ch *chain) root(contract string, id string) (*data.Call, error) {
+	call, err := data.GetCallAt(ch.commit.Hash, contract, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read call %s: %w", id, err)
+	}
+	for call.Parent != nil {
+		parent, err := data.GetCallAt(ch.commit.Hash, call.Parent.ContractId, call.Parent.Id)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read call %s, parent of %s: %w",
+				call.Parent.Id, call.Id, err)
+		}
+		call = parent
+	}
+	return call, nil
+}
+
+// contractData is a contract as the calls of the chain see it.
+func (ch *chain) contractData(id string) (state json.RawMessage, funds int64, err error) {
+	state, ok := ch.states[id]
+	if !ok {
+		base := path.Join("contracts", id)
+		if err := data.ReadJSONAt(ch.commit.Hash+"^", path.Join(base, "state.json"), &state); err != nil {
+			return nil, 0, errors.New("contract " + id + " not found")
+		}
+		data.ReadJSONAt(ch.commit.Hash+"^", path.Join(base, "funds.json"), &funds)
+		ch.states[id] = state
+		ch.funds[id] = funds
+	}
+	return state, ch.funds[id], nil
+}
+
+func (ch *chain) storage(id string) map[string]json.RawMessage {
+	storage, ok := ch.storages[id]
+	if !ok {
+		storage = make(map[string]json.RawMessage)
+		ch.storages[id] = storage
+	}
+	return storage
+}
+
+// replay replays a call and, through it, all the calls it has made.
+func (ch *chain) replay(call *data.Call) error {
+	if call.Time.IsZero() {
+		call.Time = ch.commit.Time
+	}
+	ch.prepare(call)
+
+	state, funds, err := ch.contractData(call.ContractId)
+	if err != nil {
+		return err
+	}
+	base := path.Join("contracts", call.ContractId)
+	code, err := data.ReadFileAt(ch.commit.Hash, path.Join(base, "contract.lua"))
+	if err != nil {
+		return err
+	}
+	var libraries map[string]string
+	data.ReadJSONAt(ch.commit.Hash, path.Join(base, "libraries.json"), &libraries)
+	contract := data.Contract{
+		Id:        call.ContractId,
+		Code:      string(code),
+		State:     state,
+		Funds:     funds,
+		Libraries: libraries,
+	}
+
+	ch.done[call.ContractId+"/"+call.Id] = true
+	newState, spent, err := replayCall(ch, contract, call)
+	if ch.diverged != nil {
+		return ch.diverged
+	}
+	if err != nil {
+		return fmt.Errorf("diverged at call %s (%s.%s, commit %s): %w",
+			call.Id, call.ContractId, call.Method, ch.commit.Hash, err)
+	}
+	ch.states[call.ContractId] = newState
+	ch.funds[call.ContractId] -= spent
+	ch.replayed[call.ContractId]++
+	return nil
+}
+
+// replayCall runs a call with all its recorded inputs and returns the new
+// state and how much the contract has sent to others. calls to other
+// contracts are replayed too and storage changes are written to the chain.
+func replayCall(
+	ch *chain,
+	contract data.Contract,
+	call *data.Call,
+) (
+	state json.RawMessage,
+	spent int64,
+	err error,
+) {
+	commit := ch.commit
+	before := commit.Hash + "^"
+	storage := ch.storage(contract.Id)
+
+	httpIndex := 0
+	randomIndex := 0
+	queryIndex := 0
+	subcalls := 0
+	scheduled := 0
+	held := 0
+	storagePath := path.Join("contracts", contract.Id, "storage")
+
+	stateAfter, returned, _, err := runlua.RunCall(
+		context.Background(),
+		log,
+		ioutil.Discard,
+		runlua.Callbacks{
+			// http requests are served from the recorded responses
+			MakeRequest: func(r *http.Request) (*http.Response, error) {
+				if httpIndex >= len(call.HTTP) {
+					return nil, fmt.Errorf("request to %s was not recorded", r.URL)
+				}
+				record := call.HTTP[httpIndex]
+				httpIndex++
+
+				if record.Method != r.Method || record.URL != r.URL.String() {
+					return nil, fmt.Errorf("request %s %s differs from recorded %s %s",
+						r.Method, r.URL, record.Method, record.URL)
+				}
+				if record.Error != "" {
+					return nil, errors.New(record.Error)
+				}
+				if record.BodyTruncated {
+					return nil, fmt.Errorf("recorded response from %s is truncated", r.URL)
+				}
+				hash := sha256.Sum256([]byte(record.Body))
+				if hex.EncodeToString(hash[:]) != record.BodyHash {
+					return nil, fmt.Errorf("recorded response from %s doesn't match its hash", r.URL)
+				}
+
+				return &http.Response{
+					Status:        http.StatusText(record.Status),
+					StatusCode:    record.Status,
+					Proto:         "HTTP/1.0",
+					ProtoMajor:    1,
+					ProtoMinor:    0,
+					Request:       r,
+					Body:          ioutil.NopCloser(bytes.NewBufferString(record.Body)),
+					ContentLength: int64(len(record.Body)),
+				}, nil
+			},
+
+			// other contracts are read with the changes made earlier in the chain
+			GetExternalContractData: func(id string) (interface{}, int64, error) {
+				jstate, funds, err := ch.contractData(id)
+				if err != nil {
+					return nil, 0, err
+				}
+				var state interface{}
+				err = json.Unmarshal(jstate, &state)
+				return state, funds, err
+			},
+
+			// external calls are replayed so the calls after them see their
+			// effects, here we account for the money sent and return what the
+			// other contract has returned
+			CallExternalMethod: func(id string, _ string, _ interface{}, msatoshi int64, _ int64) (interface{}, int64, error) {
+				spent += 1000 + msatoshi
+
+				// calls made before sub-calls had their own ids used the same id
+				subcallId := call.Id
+				if subcalls < len(call.Calls) {
+					ref := call.Calls[subcalls]
+					if ref.ContractId != id {
+						return nil, 0, fmt.Errorf("call to %s differs from recorded call to %s",
+							id, ref.ContractId)
+					}
+					subcallId = ref.Id
+				}
+				subcalls++
+
+				external, err := data.GetCallAt(commit.Hash, id, subcallId)
+				if err != nil {
+					return nil, 0, errors.New("call to " + id + " was not recorded")
+				}
+				if err := ch.replay(external); err != nil {
+					if ch.diverged == nil {
+						ch.diverged = err
+					}
+					return nil, 0, err
+				}
+				var result interface{}
+				if len(external.Result) > 0 {
+					err = json.Unmarshal(external.Result, &result)
+				}
+				return result, external.GasUsed, err
+			},
+
+			// queries are served from the recorded results
+			QueryExternalMethod: func(id string, method string, _ interface{}, _ int64) (interface{}, int64, error) {
+				if queryIndex >= len(call.Queries) {
+					return nil, 0, fmt.Errorf("query to %s was not recorded", id)
+				}
+				query := call.Queries[queryIndex]
+				queryIndex++
+
+				if query.ContractId != id || query.Method != method {
+					return nil, 0, fmt.Errorf("query %s.%s differs from recorded %s.%s",
+						id, method, query.ContractId, query.Method)
+				}
+				var result interface{}
+				if len(query.Result) > 0 {
+					err = json.Unmarshal(query.Result, &result)
+				}
+				return result, query.GasUsed, err
+			},
+
+			GetContractFunds: func() (int64, error) { return contract.Funds, nil },
+			SendFromContract: func(target string, msatoshi int64) (int64, error) {
+				if len(target) == 0 {
+					return 0, errors.New("can't send to blank recipient")
+				}
+				spent += msatoshi
+				return msatoshi, nil
+			},
+
+			EmitEvent: func(_ string, _ interface{}) error { return nil },
+			ScheduleCall: func(_ string, _ interface{}, _ int64) (string, error) {
+				// ids are derived from the call id, so they don't have to be recorded
+				id := data.ScheduleId(call.Id, scheduled)
+				scheduled++
+				return id, nil
+			},
+
+			// random bytes are served from the recorded ones
+			GetRandomBytes: func(n int) (string, error) {
+				if randomIndex >= len(call.Random) {
+					return "", errors.New("random bytes were not recorded")
+				}
+				random := call.Random[randomIndex]
+				randomIndex++
+				if len(random) != n*2 {
+					return "", fmt.Errorf("recorded random bytes have length %d, not %d",
+						len(random)/2, n)
+				}
+				return random, nil
+			},
+
+			GetStorage: func(key string) (value interface{}, err error) {
+				jvalue, ok := storage[key]
+				if !ok {
+					jvalue, _ = data.ReadFileAt(before, path.Join(storagePath, data.StorageKeyFile(key)))
+				}
+				if jvalue == nil {
+					return nil, nil
+				}
+				err = json.Unmarshal(jvalue, &value)
+				return value, err
+			},
+
+			SetStorage: func(key string, value interface{}) error {
+				jvalue, err := json.Marshal(value)
+				storage[key] = jvalue
+				return err
+			},
+
+			DeleteStorage: func(key string) error {
+				storage[key] = nil
+				return nil
+			},
+
+			ListStorageKeys: func(prefix string) ([]string, error) {
+				saved, _ := data.ListStorageKeysAt(before, contract.Id, prefix)
+				exists := make(map[string]bool)
+				for _, key := range saved {
+					exists[key] = true
+				}
+				for key, value := range storage {
+					if strings.HasPrefix(key, prefix) {
+						exists[key] = value != nil
+					}
+				}
+				keys := make([]string, 0, len(exists))
+				for key, ok := range exists {
+					if ok {
+						keys = append(keys, key)
+					}
+				}
+				sort.Strings(keys)
+				return keys, nil
+			},
+
+			GetLibraryCode: func(id string, hash string) (string, map[string]string, error) {
+				base := path.Join("contracts", id)
+				code, err := data.ReadFileAt(before, path.Join(base, "contract.lua"))
+				if err != nil {
+					return "", nil, errors.New("library " + id + " not found")
+				}
+				if data.CodeHash(string(code)) != hash {
+					return "", nil, errors.New("library " + id + " doesn't match the pinned version")
+				}
+				var libraries map[string]string
+				data.ReadJSONAt(before, path.Join(base, "libraries.json"), &libraries)
+				return string(code), libraries, nil
+			},
+
+			GetCurrentAccountBalance: func() (int64, error) {
+				if call.Caller == "" {
+					return 0, errors.New("no account")
+				}
+				var balance int64
+				data.ReadJSONAt(before,
+					path.Join("accounts", call.Caller, "balance.json"), &balance)
+				return balance, nil
+			},
+
+			// what accounts send is checked with the transfers of the commit
+			SendFromAccount: func(target string, msatoshi int64) (int64, error) {
+				if call.Caller == "" || call.Caller[0] == 'c' {
+					return 0, errors.New("no account")
+				}
+				if len(target) == 0 {
+					return 0, errors.New("can't send to blank recipient")
+				}
+				if msatoshi <= 0 {
+					return 0, errors.New("amount must be positive")
+				}
+				return msatoshi, nil
+			},
+
+			// held funds stay with the account until they are captured, what is
+			// captured is checked with the transfers of the commit
+			HoldFunds: func(account string, msatoshi int64, expiry int64) (string, error) {
+				if call.Caller == "" || call.Caller[0] == 'c' || account != call.Caller {
+					return "", errors.New("can only hold funds from the account making the call")
+				}
+				if msatoshi <= 0 {
+					return "", errors.New("amount must be positive")
+				}
+				if expiry <= call.Time.Unix() {
+					return "", errors.New("expiry must be in the future")
+				}
+				// ids are derived from the call id, like the schedule ids
+				id := data.HoldId(call.Id, held)
+				held++
+				return id, nil
+			},
+
+			CaptureHold: func(_ string, msatoshi int64) (int64, error) {
+				if msatoshi <= 0 {
+					return 0, errors.New("amount must be positive")
+				}
+				return msatoshi, nil
+			},
+
+			ReleaseHold: func(_ string) error { return nil },
+		},
+		contract,
+		*call,
+	)
+	if err != nil {
+		return nil, 0, fmt.Errorf("execution error: %w", err)
+	}
+
+	// calls recorded before results were saved don't have their gas either
+	if call.Method != "__init__" && call.Method != "__migrate__" && call.GasUsed > 0 &&
+		(returned != nil || len(call.Result) > 0) {
+		result, _ := json.Marshal(returned)
+		switch {
+		case returned == nil:
+			return nil, 0, fmt.Errorf("returned nothing, committed result was %s", call.Result)
+		case len(call.Result) == 0:
+			return nil, 0, fmt.Errorf("result is %s, nothing was committed", result)
+		case !jsonEqual(result, call.Result):
+			return nil, 0, fmt.Errorf("result is %s, committed was %s", result, call.Result)
+		}
+	}
+
+	state, err = json.Marshal(stateAfter)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error marshaling new state: %w", err)
+	}
+
+	return state, spent, nil
+}
+
+// checkStorage compares the storage changes made by all the calls of a
+// commit with what was committed.
+func checkStorage(commit data.Commit, contract string, storage map[string]json.RawMessage) error {
+	storagePath := path.Join("contracts", contract, "storage")
+	for key, value := range storage {
+		committed, err := data.ReadFileAt(commit.Hash, path.Join(storagePath, data.StorageKeyFile(key)))
+		if value == nil && err == nil {
+			return fmt.Errorf("storage key %s should have been deleted", key)
+		}
+		if value != nil && (err != nil || !jsonEqual(value, committed)) {
+			return fmt.Errorf("storage key %s is %s, committed was %s",
+				key, value, committed)
+		}
+	}
+	return nil
+}
+
+func jsonEqual(a, b json.RawMessage) bool {
+	var va, vb interface{}
+	if err := json.Unmarshal(a, &va); err != nil {
+		return false
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(va, vb) || strings.TrimSpace(string(a)) == strings.TrimSpace(string(b))
+}
+
+// callIdLess sorts sub-calls of the same call in the order they were made,
+// comparing each -n suffix as a number.
+func callIdLess(a, b string) bool {
+	as := strings.Split(a, "-")
+	bs := strings.Split(b, "-")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] == bs[i] {
+			continue
+		}
+		an, aerr := strconv.Atoi(as[i])
+		bn, berr := strconv.Atoi(bs[i])
+		if i > 0 && aerr == nil && berr == nil {
+			return an < bn
+		}
+		return as[i] < bs[i]
+	}
+	return len(as) < len(bs)
+}
@@ -2,13 +2,19 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"sort"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/fiatjaf/etleneum/data"
 	"github.com/fiatjaf/etleneum/runlua"
@@ -69,10 +75,28 @@ func main() {
 			Value: 0,
 			Usage: "Msatoshi to include in the call.",
 		},
+		cli.Int64Flag{
+			Name:  "gas",
+			Value: runlua.MaxGasLimit,
+			Usage: "Maximum gas the call is allowed to use.",
+		},
+		cli.Int64Flag{
+			Name:  "memory",
+			Value: runlua.MemoryLimit >> 20,
+			Usage: "Maximum memory the call is allowed to use (in megabytes).",
+		},
 		cli.StringSliceFlag{
 			Name:  "http",
 			Usage: "HTTP response to mock. Can be called multiple times. Will return the multiple values in order to each HTTP call made by the contract.",
 		},
+		cli.StringSliceFlag{
+			Name:  "query",
+			Usage: "JSON result to mock for etleneum.query. Can be called multiple times. Will return the multiple values in order to each query made by the contract.",
+		},
+		cli.StringSliceFlag{
+			Name:  "library",
+			Usage: "Library to make available to require(), as <contract id>=<file>. Can be called multiple times.",
+		},
 	}
 	app.Action = func(c *cli.Context) error {
 		// contract code
@@ -87,6 +111,31 @@ func main() {
 			os.Exit(1)
 		}
 
+		// libraries
+		libraryCode := make(map[string]string)
+		for _, lib := range c.StringSlice("library") {
+			spl := strings.SplitN(lib, "=", 2)
+			if len(spl) != 2 {
+				fmt.Fprintf(app.ErrWriter, "invalid library '%s', should be <id>=<file>.", lib)
+				os.Exit(1)
+			}
+			code, err := ioutil.ReadFile(spl[1])
+			if err != nil {
+				fmt.Fprintf(app.ErrWriter, "failed to read library file '%s'.", spl[1])
+				os.Exit(1)
+			}
+			libraryCode[spl[0]] = string(code)
+		}
+		pins := func(code string) map[string]string {
+			libraries := make(map[string]string)
+			for _, id := range data.RequiredLibraries(code) {
+				if code, ok := libraryCode[id]; ok {
+					libraries[id] = data.CodeHash(code)
+				}
+			}
+			return libraries
+		}
+
 		// http mock
 		httpResponses := c.StringSlice("http")
 		httpRespIndex := 0
@@ -111,6 +160,19 @@ func main() {
 			return http.DefaultClient.Do(r)
 		}
 
+		// query mock
+		queryResults := c.StringSlice("query")
+		queryIndex := 0
+		returnQuery := func(id, method string, _ interface{}, _ int64) (result interface{}, gasUsed int64, err error) {
+			if queryIndex >= len(queryResults) {
+				return nil, 0, errors.New("no external contracts in test environment")
+			}
+			err = json.Unmarshal([]byte(queryResults[queryIndex]), &result)
+			queryIndex++
+			fmt.Fprintf(os.Stderr, "query %s.%s\n", id, method)
+			return result, 0, err
+		}
+
 		contractFunds := c.Int64("funds") * 1000
 
 		var statejson []byte
@@ -125,32 +187,130 @@ func main() {
 			statejson = []byte(c.String("state"))
 		}
 
+		runlua.MemoryLimit = c.Int64("memory") << 20
+
+		// the gas given here is the cap, even if it's above the default one
+		if c.Int64("gas") <= 0 {
+			fmt.Fprint(app.ErrWriter, "gas must be positive.")
+			os.Exit(1)
+		}
+		runlua.MaxGasLimit = c.Int64("gas")
+
+		storage := make(map[string]interface{})
+
 		msatoshi := c.Int64("msatoshi")
 		if msatoshi == 0 {
 			msatoshi = int64(1000 * c.Float64("satoshis"))
 		}
 
-		state, err := runlua.RunCall(
+		state, _, gasUsed, err := runlua.RunCall(
+			context.Background(),
 			log,
 			os.Stderr,
-			returnHttp,
-			func(_ string) (interface{}, int64, error) {
-				return nil, 0, errors.New("no external contracts in test environment")
-			},
-			func(_, _ string, _ interface{}, _ int64) error {
-				return errors.New("no external contracts in test environment")
-			},
-			func() (contractFunds int64, err error) { return contractFunds, nil },
-			func(target string, msat int64) (msatoshiSent int64, err error) {
-				contractFunds -= int64(msat)
-				fmt.Fprintf(os.Stderr, "%dmsat sent to %s\n", msat, target)
-				return msat, nil
+			runlua.Callbacks{
+				MakeRequest: returnHttp,
+				GetExternalContractData: func(_ string) (interface{}, int64, error) {
+					return nil, 0, errors.New("no external contracts in test environment")
+				},
+
+				CallExternalMethod: func(_, _ string, _ interface{}, _ int64, _ int64) (interface{}, int64, error) {
+					return nil, 0, errors.New("no external contracts in test environment")
+				},
+
+				QueryExternalMethod: returnQuery,
+				GetContractFunds:    func() (contractFunds int64, err error) { return contractFunds, nil },
+				SendFromContract: func(target string, msat int64) (msatoshiSent int64, err error) {
+					contractFunds -= int64(msat)
+					fmt.Fprintf(os.Stderr, "%dmsat sent to %s\n", msat, target)
+					return msat, nil
+				},
+
+				EmitEvent: func(name string, data interface{}) error {
+					jdata, _ := json.Marshal(data)
+					fmt.Fprintf(os.Stderr, "event %s emitted: %s\n", name, jdata)
+					return nil
+				},
+
+				ScheduleCall: func(method string, payload interface{}, at int64) (string, error) {
+					jpayload, _ := json.Marshal(payload)
+					fmt.Fprintf(os.Stderr, "%s scheduled at %s with payload %s\n",
+						method, time.Unix(at, 0).Format(time.RFC3339), jpayload)
+					return "scheduleid", nil
+				},
+
+				GetRandomBytes: func(n int) (string, error) {
+					b := make([]byte, n)
+					rand.Read(b)
+					return hex.EncodeToString(b), nil
+				},
+
+				GetStorage: func(key string) (interface{}, error) { return storage[key], nil },
+				SetStorage: func(key string, value interface{}) error {
+					jvalue, _ := json.Marshal(value)
+					fmt.Fprintf(os.Stderr, "storage %s set to %s\n", key, jvalue)
+					storage[key] = value
+					return nil
+				},
+
+				DeleteStorage: func(key string) error {
+					fmt.Fprintf(os.Stderr, "storage %s deleted\n", key)
+					delete(storage, key)
+					return nil
+				},
+
+				ListStorageKeys: func(prefix string) ([]string, error) {
+					keys := make([]string, 0, len(storage))
+					for key := range storage {
+						if strings.HasPrefix(key, prefix) {
+							keys = append(keys, key)
+						}
+					}
+					sort.Strings(keys)
+					return keys, nil
+				},
+
+				GetLibraryCode: func(id string, _ string) (string, map[string]string, error) {
+					code, ok := libraryCode[id]
+					if !ok {
+						return "", nil, errors.New("library " + id + " not found")
+					}
+					return code, pins(code), nil
+				},
+
+				GetCurrentAccountBalance: func() (userBalance int64, err error) { return 99999, nil },
+				SendFromAccount: func(target string, msat int64) (msatoshiSent int64, err error) {
+					if c.String("caller") == "" {
+						return 0, errors.New("no account")
+					}
+					fmt.Fprintf(os.Stderr, "%dmsat sent from %s to %s\n", msat, c.String("caller"), target)
+					return msat, nil
+				},
+
+				HoldFunds: func(account string, msat int64, expiry int64) (string, error) {
+					if c.String("caller") == "" || account != c.String("caller") {
+						return "", errors.New("can only hold funds from the account making the call")
+					}
+					fmt.Fprintf(os.Stderr, "%dmsat held from %s until %s\n",
+						msat, account, time.Unix(expiry, 0).Format(time.RFC3339))
+					return "holdid", nil
+				},
+
+				CaptureHold: func(id string, msat int64) (msatoshiCaptured int64, err error) {
+					contractFunds += msat
+					fmt.Fprintf(os.Stderr, "%dmsat captured from hold %s\n", msat, id)
+					return msat, nil
+				},
+
+				ReleaseHold: func(id string) error {
+					fmt.Fprintf(os.Stderr, "hold %s released\n", id)
+					return nil
+				},
 			},
-			func() (userBalance int64, err error) { return 99999, nil },
 			data.Contract{
-				Code:  string(bcontractCode),
-				State: json.RawMessage(statejson),
-				Funds: contractFunds,
+				Code:      string(bcontractCode),
+				State:     json.RawMessage(statejson),
+				Funds:     contractFunds,
+				Libraries: pins(string(bcontractCode)),
 			},
 			data.Call{
 				Id:       "callid",
@@ -158,12 +318,14 @@ func main() {
 				Method:   c.String("method"),
 				Payload:  json.RawMessage(c.String("payload")),
 				Caller:   c.String("caller"),
+				GasLimit: c.Int64("gas"),
 			},
 		)
 		if err != nil {
 			fmt.Fprintln(app.ErrWriter, "execution error: "+err.Error())
 			os.Exit(3)
 		}
+		fmt.Fprintf(os.Stderr, "gas used: %d\n", gasUsed)
 
 		if stateFile != "" {
 			f, err := os.Create(stateFile)
@@ -181,6 +343,40 @@ func main() {
 		return nil
 	}
 
+	app.Commands = []cli.Command{
+		{
+			Name:      "lint",
+			Usage:     "Check a contract for common mistakes without running it. Exits with 5 if anything is found.",
+			ArgsUsage: "<contract file>",
+			Action: func(c *cli.Context) error {
+				contractFile := c.Args().First()
+				if contractFile == "" {
+					fmt.Fprint(app.ErrWriter, "missing contract file.")
+					os.Exit(1)
+				}
+				bcontractCode, err := ioutil.ReadFile(contractFile)
+				if err != nil {
+					fmt.Fprintf(app.ErrWriter, "failed to read contract file '%s'.", contractFile)
+					os.Exit(1)
+				}
+
+				warnings, err := runlua.Lint(string(bcontractCode))
+				if err != nil {
+					fmt.Fprintf(app.ErrWriter, "%s:%s\n", contractFile, strings.TrimPrefix(err.Error(), "line "))
+					os.Exit(1)
+				}
+				for _, warning := range warnings {
+					fmt.Fprintf(app.Writer, "%s:%d: %s (%s)\n",
+						contractFile, warning.Line, warning.Message, warning.Kind)
+				}
+				if len(warnings) > 0 {
+					os.Exit(5)
+				}
+				return nil
+			},
+		},
+	}
+
 	err := app.Run(os.Args)
 	if err != nil {
 		fmt.Fprint(app.ErrWriter, err.Error())
@@ -6,16 +6,30 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcutil"
 	decodepay "github.com/fiatjaf/ln-decodepay"
+	"github.com/rs/zerolog"
 )
 
-func make_lua_http(makeRequest func(*http.Request) (*http.Response, error)) (
+// MaxHTTPRequests is how many http requests a contract can make in a single
+// call, MaxHTTPResponseSize is the maximum size of each response body.
+var (
+	MaxHTTPRequests           = 10
+	MaxHTTPResponseSize int64 = 512 << 10
+)
+
+func make_lua_http(
+	logger zerolog.Logger,
+	makeRequest func(*http.Request) (*http.Response, error),
+) (
 	lua_http_gettext func(string, ...map[string]interface{}) (string, error),
 	lua_http_getjson func(string, ...map[string]interface{}) (interface{}, error),
 	lua_http_postjson func(string, interface{}, ...map[string]interface{}) (interface{}, error),
@@ -25,13 +39,13 @@ func make_lua_http(makeRequest func(*http.Request) (*http.Response, error)) (
 	calls_p = &calls
 
 	http_call := func(method, url string, body interface{}, headers ...map[string]interface{}) (b []byte, err error) {
-		log.Debug().Str("method", method).Interface("body", body).Str("url", url).Msg("http call from contract")
+		logger.Debug().Str("method", method).Interface("body", body).Str("url", url).Msg("http call from contract")
 
 		bodyjson := new(bytes.Buffer)
 		if body != nil {
 			err = json.NewEncoder(bodyjson).Encode(body)
 			if err != nil {
-				log.Warn().Err(err).Msg("http: failed to encode body")
+				logger.Warn().Err(err).Msg("http: failed to encode body")
 				return
 			}
 			headers = append([]map[string]interface{}{{"Content-Type": "application/json"}}, headers...)
@@ -39,7 +53,7 @@ func make_lua_http(makeRequest func(*http.Request) (*http.Response, error)) (
 
 		req, err := http.NewRequest(method, url, bodyjson)
 		if err != nil {
-			log.Warn().Err(err).Msg("http: failed to create request")
+			logger.Warn().Err(err).Msg("http: failed to create request")
 			return
 		}
 		defer req.Body.Close()
@@ -52,23 +66,34 @@ func make_lua_http(makeRequest func(*http.Request) (*http.Response, error)) (
 			}
 		}
 
+		if calls >= MaxHTTPRequests {
+			err = fmt.Errorf("can't make more than %d http requests in a single call", MaxHTTPRequests)
+			return
+		}
+		calls++
+
 		resp, err := makeRequest(req)
 		if err != nil {
-			log.Warn().Err(err).Msg("http: failed to make request")
+			logger.Warn().Err(err).Msg("http: failed to make request")
 			return
 		}
+		defer resp.Body.Close()
 
 		if resp.StatusCode >= 300 {
-			log.Debug().Err(err).Int("code", resp.StatusCode).Msg("http: got bad status")
+			logger.Debug().Err(err).Int("code", resp.StatusCode).Msg("http: got bad status")
 			err = errors.New("response status code: " + strconv.Itoa(resp.StatusCode))
 			return
 		}
 
-		b, err = ioutil.ReadAll(resp.Body)
+		b, err = ioutil.ReadAll(io.LimitReader(resp.Body, MaxHTTPResponseSize+1))
 		if err != nil {
-			log.Warn().Err(err).Msg("http: failed to read body")
+			logger.Warn().Err(err).Msg("http: failed to read body")
 			return
 		}
+		if int64(len(b)) > MaxHTTPResponseSize {
+			err = fmt.Errorf("response body is bigger than %d bytes", MaxHTTPResponseSize)
+			return nil, err
+		}
 
 		return b, nil
 	}
@@ -124,6 +149,26 @@ func lua_sha256(preimage string) (hash string, err error) {
 	return hash, nil
 }
 
+// lua_json_encode encodes with sorted object keys and no HTML escaping, so the
+// result can be used in signatures and hashes.
+func lua_json_encode(value interface{}) (string, error) {
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(value); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+func lua_json_decode(text string) (interface{}, error) {
+	var value interface{}
+	if err := json.Unmarshal([]byte(text), &value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
 func lua_parse_bolt11(bolt11 string) (map[string]interface{}, error) {
 	inv, err := decodepay.Decodepay(bolt11)
 	if err != nil {
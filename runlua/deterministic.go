@@ -0,0 +1,86 @@
+package runlua
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// callRandom is the source behind math.random. It is seeded from the contract
+// and call ids so running the same call again gives the same numbers.
+func callRandom(contractId, callId string) *rand.Rand {
+	hash := sha256.Sum256([]byte(contractId + ":" + callId))
+	seed := int64(binary.BigEndian.Uint64(hash[0:8]))
+	return rand.New(rand.NewSource(seed))
+}
+
+func make_lua_random_int(random *rand.Rand) func(int64, int64) (int64, error) {
+	return func(m, n int64) (int64, error) {
+		if n < m {
+			return 0, errors.New("interval is empty")
+		}
+		return m + random.Int63n(n-m+1), nil
+	}
+}
+
+// make_lua_cuid replaces cuid.Slug for contracts, the ids look the same but
+// come from the call random source.
+func make_lua_cuid(random *rand.Rand) func() string {
+	const chars = "0123456789abcdefghijklmnopqrstuvwxyz"
+	return func() string {
+		id := make([]byte, 10)
+		for i := range id {
+			id[i] = chars[random.Intn(len(chars))]
+		}
+		return string(id)
+	}
+}
+
+// lua_date_to_time is os.time(table), but always in UTC instead of in the
+// local timezone of whoever is running the call.
+func lua_date_to_time(date map[string]interface{}) (int64, error) {
+	field := func(name string, def int) (int, error) {
+		v, ok := date[name]
+		if !ok {
+			if def < 0 {
+				return 0, errors.New("field '" + name + "' missing in date table")
+			}
+			return def, nil
+		}
+		n, ok := v.(float64)
+		if !ok {
+			return 0, errors.New("field '" + name + "' is not a number")
+		}
+		return int(n), nil
+	}
+
+	year, err := field("year", -1)
+	if err != nil {
+		return 0, err
+	}
+	month, err := field("month", -1)
+	if err != nil {
+		return 0, err
+	}
+	day, err := field("day", -1)
+	if err != nil {
+		return 0, err
+	}
+	hour, err := field("hour", 12)
+	if err != nil {
+		return 0, err
+	}
+	min, err := field("min", 0)
+	if err != nil {
+		return 0, err
+	}
+	sec, err := field("sec", 0)
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Date(year, time.Month(month), day, hour, min, sec, 0, time.UTC).
+		Unix(), nil
+}
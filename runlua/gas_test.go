@@ -0,0 +1,108 @@
+package runlua
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/etleneum/data"
+	"github.com/rs/zerolog"
+)
+
+var gasContract = data.Contract{
+	Id: "cgas",
+	Code: `
+function loop ()
+  while true do end
+end
+
+function sum ()
+  local n = 0
+  for i = 1, 1000 do n = n + i end
+  return n
+end
+
+function nested ()
+  return etleneum.call_external('cother', 'f', {}, 0)
+end
+`,
+	State: []byte(`{}`),
+}
+
+func runGasCall(t *testing.T, callbacks Callbacks, method string, gasLimit int64) (interface{}, int64, error) {
+	t.Helper()
+	_, returned, gasUsed, err := RunCall(context.Background(), zerolog.Nop(), ioutil.Discard,
+		callbacks, gasContract,
+		data.Call{Id: "rgas", ContractId: gasContract.Id, Method: method,
+			Payload: []byte(`{}`), GasLimit: gasLimit})
+	return returned, gasUsed, err
+}
+
+func TestOutOfGas(t *testing.T) {
+	_, gasUsed, err := runGasCall(t, Callbacks{}, "loop", 10000)
+	if err == nil || !strings.Contains(err.Error(), "out of gas!") {
+		t.Fatalf("expected out of gas, got %v", err)
+	}
+	if gasUsed <= 10000 || gasUsed > 10000+gasStep {
+		t.Fatalf("gas used should be just above the limit, got %d", gasUsed)
+	}
+
+	// limits above the maximum are capped
+	defer func(limit int64) { MaxGasLimit = limit }(MaxGasLimit)
+	MaxGasLimit = 20000
+	_, gasUsed, err = runGasCall(t, Callbacks{}, "loop", 1000000)
+	if err == nil || gasUsed > MaxGasLimit+gasStep {
+		t.Fatalf("expected out of gas at %d, got %d (%v)", MaxGasLimit, gasUsed, err)
+	}
+}
+
+func TestGasUsed(t *testing.T) {
+	returned, gasUsed, err := runGasCall(t, Callbacks{}, "sum", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(returned) != "500500" {
+		t.Fatalf("unexpected result %v", returned)
+	}
+	if gasUsed <= 0 || gasUsed%gasStep != 0 {
+		t.Fatalf("unexpected gas used %d", gasUsed)
+	}
+
+	// the same call uses the same gas
+	_, again, _ := runGasCall(t, Callbacks{}, "sum", 0)
+	if again != gasUsed {
+		t.Fatalf("gas used changed from %d to %d", gasUsed, again)
+	}
+}
+
+func TestNestedCallGas(t *testing.T) {
+	var given int64
+	callbacks := Callbacks{
+		CallExternalMethod: func(_, _ string, _ interface{}, _ int64, gasLimit int64) (interface{}, int64, error) {
+			given = gasLimit
+			return "ok", 5000, nil
+		},
+	}
+
+	_, gasUsed, err := runGasCall(t, callbacks, "nested", 100000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if given <= 0 || given >= 100000 {
+		t.Fatalf("nested call should get what is left, got %d", given)
+	}
+	if gasUsed < 5000 {
+		t.Fatalf("nested gas wasn't counted, got %d", gasUsed)
+	}
+
+	// the nested call has used everything that was left
+	callbacks.CallExternalMethod = func(_, _ string, _ interface{}, _ int64, gasLimit int64) (interface{}, int64, error) {
+		return "ok", gasLimit + 1, nil
+	}
+	_, _, err = runGasCall(t, callbacks, "nested", 100000)
+	if err == nil || !strings.Contains(err.Error(), "out of gas!") {
+		t.Fatalf("expected out of gas, got %v", err)
+	}
+}
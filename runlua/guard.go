@@ -0,0 +1,360 @@
+package runlua
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+)
+
+var (
+	errCallFinished = errors.New("call has already finished")
+	errUnavailable  = errors.New("not available in this call")
+)
+
+// guard wraps the functions given to RunCall such that they can't be called
+// anymore once it is closed.
+type guard struct {
+	sync.Mutex
+	closed bool
+}
+
+func (g *guard) enter() bool {
+	g.Lock()
+	if g.closed {
+		g.Unlock()
+		return false
+	}
+	return true
+}
+
+func (g *guard) leave() {
+	g.Unlock()
+}
+
+// close blocks until the function currently running (if any) has returned.
+func (g *guard) close() {
+	g.Lock()
+	g.closed = true
+	g.Unlock()
+}
+
+// wrap applies the guard to all the callbacks, the ones that are nil return
+// an error when called.
+func (g *guard) wrap(ctx context.Context, cb Callbacks) Callbacks {
+	return Callbacks{
+		MakeRequest:              g.makeRequest(ctx, cb.MakeRequest),
+		GetExternalContractData:  g.getExternalContractData(cb.GetExternalContractData),
+		CallExternalMethod:       g.callExternalMethod(cb.CallExternalMethod),
+		QueryExternalMethod:      g.queryExternalMethod(cb.QueryExternalMethod),
+		GetContractFunds:         g.getContractFunds(cb.GetContractFunds),
+		SendFromContract:         g.sendFromContract(cb.SendFromContract),
+		EmitEvent:                g.emitEvent(cb.EmitEvent),
+		ScheduleCall:             g.scheduleCall(cb.ScheduleCall),
+		GetRandomBytes:           g.getRandomBytes(cb.GetRandomBytes),
+		GetStorage:               g.getStorage(cb.GetStorage),
+		SetStorage:               g.setStorage(cb.SetStorage),
+		DeleteStorage:            g.deleteStorage(cb.DeleteStorage),
+		ListStorageKeys:          g.listStorageKeys(cb.ListStorageKeys),
+		GetLibraryCode:           g.getLibraryCode(cb.GetLibraryCode),
+		GetCurrentAccountBalance: g.getCurrentAccountBalance(cb.GetCurrentAccountBalance),
+		SendFromAccount:          g.sendFromAccount(cb.SendFromAccount),
+		HoldFunds:                g.holdFunds(cb.HoldFunds),
+		CaptureHold:              g.captureHold(cb.CaptureHold),
+		ReleaseHold:              g.releaseHold(cb.ReleaseHold),
+	}
+}
+
+type guardedWriter struct {
+	g *guard
+	w io.Writer
+}
+
+func (gw guardedWriter) Write(p []byte) (n int, err error) {
+	if !gw.g.enter() {
+		return 0, errCallFinished
+	}
+	defer gw.g.leave()
+	return gw.w.Write(p)
+}
+
+func (g *guard) writer(w io.Writer) io.Writer {
+	return guardedWriter{g, w}
+}
+
+func (g *guard) makeRequest(
+	ctx context.Context,
+	f func(*http.Request) (*http.Response, error),
+) func(*http.Request) (*http.Response, error) {
+	return func(r *http.Request) (*http.Response, error) {
+		if !g.enter() {
+			return nil, errCallFinished
+		}
+		defer g.leave()
+		if f == nil {
+			return nil, errUnavailable
+		}
+		return f(r.WithContext(ctx))
+	}
+}
+
+func (g *guard) getExternalContractData(
+	f func(string) (interface{}, int64, error),
+) func(string) (interface{}, int64, error) {
+	return func(id string) (interface{}, int64, error) {
+		if !g.enter() {
+			return nil, 0, errCallFinished
+		}
+		defer g.leave()
+		if f == nil {
+			return nil, 0, errUnavailable
+		}
+		return f(id)
+	}
+}
+
+func (g *guard) callExternalMethod(
+	f func(string, string, interface{}, int64, int64) (interface{}, int64, error),
+) func(string, string, interface{}, int64, int64) (interface{}, int64, error) {
+	return func(contract, method string, payload interface{}, msatoshi int64, gasLimit int64) (interface{}, int64, error) {
+		if !g.enter() {
+			return nil, 0, errCallFinished
+		}
+		defer g.leave()
+		if f == nil {
+			return nil, 0, errUnavailable
+		}
+		return f(contract, method, payload, msatoshi, gasLimit)
+	}
+}
+
+func (g *guard) queryExternalMethod(
+	f func(string, string, interface{}, int64) (interface{}, int64, error),
+) func(string, string, interface{}, int64) (interface{}, int64, error) {
+	return func(contract, method string, payload interface{}, gasLimit int64) (interface{}, int64, error) {
+		if !g.enter() {
+			return nil, 0, errCallFinished
+		}
+		defer g.leave()
+		if f == nil {
+			return nil, 0, errUnavailable
+		}
+		return f(contract, method, payload, gasLimit)
+	}
+}
+
+func (g *guard) getContractFunds(f func() (int64, error)) func() (int64, error) {
+	return func() (int64, error) {
+		if !g.enter() {
+			return 0, errCallFinished
+		}
+		defer g.leave()
+		if f == nil {
+			return 0, errUnavailable
+		}
+		return f()
+	}
+}
+
+func (g *guard) sendFromContract(
+	f func(string, int64) (int64, error),
+) func(string, int64) (int64, error) {
+	return func(target string, msat int64) (int64, error) {
+		if !g.enter() {
+			return 0, errCallFinished
+		}
+		defer g.leave()
+		if f == nil {
+			return 0, errUnavailable
+		}
+		return f(target, msat)
+	}
+}
+
+func (g *guard) emitEvent(
+	f func(string, interface{}) error,
+) func(string, interface{}) error {
+	return func(name string, data interface{}) error {
+		if !g.enter() {
+			return errCallFinished
+		}
+		defer g.leave()
+		if f == nil {
+			return errUnavailable
+		}
+		return f(name, data)
+	}
+}
+
+func (g *guard) scheduleCall(
+	f func(string, interface{}, int64) (string, error),
+) func(string, interface{}, int64) (string, error) {
+	return func(method string, payload interface{}, at int64) (string, error) {
+		if !g.enter() {
+			return "", errCallFinished
+		}
+		defer g.leave()
+		if f == nil {
+			return "", errUnavailable
+		}
+		return f(method, payload, at)
+	}
+}
+
+func (g *guard) getRandomBytes(f func(int) (string, error)) func(int) (string, error) {
+	return func(n int) (string, error) {
+		if !g.enter() {
+			return "", errCallFinished
+		}
+		defer g.leave()
+		if f == nil {
+			return "", errUnavailable
+		}
+		return f(n)
+	}
+}
+
+func (g *guard) getStorage(
+	f func(string) (interface{}, error),
+) func(string) (interface{}, error) {
+	return func(key string) (interface{}, error) {
+		if !g.enter() {
+			return nil, errCallFinished
+		}
+		defer g.leave()
+		if f == nil {
+			return nil, errUnavailable
+		}
+		return f(key)
+	}
+}
+
+func (g *guard) setStorage(
+	f func(string, interface{}) error,
+) func(string, interface{}) error {
+	return func(key string, value interface{}) error {
+		if !g.enter() {
+			return errCallFinished
+		}
+		defer g.leave()
+		if f == nil {
+			return errUnavailable
+		}
+		return f(key, value)
+	}
+}
+
+func (g *guard) deleteStorage(f func(string) error) func(string) error {
+	return func(key string) error {
+		if !g.enter() {
+			return errCallFinished
+		}
+		defer g.leave()
+		if f == nil {
+			return errUnavailable
+		}
+		return f(key)
+	}
+}
+
+func (g *guard) listStorageKeys(
+	f func(string) ([]string, error),
+) func(string) ([]string, error) {
+	return func(prefix string) ([]string, error) {
+		if !g.enter() {
+			return nil, errCallFinished
+		}
+		defer g.leave()
+		if f == nil {
+			return nil, errUnavailable
+		}
+		return f(prefix)
+	}
+}
+
+func (g *guard) getLibraryCode(
+	f func(string, string) (string, map[string]string, error),
+) func(string, string) (string, map[string]string, error) {
+	return func(id string, hash string) (string, map[string]string, error) {
+		if !g.enter() {
+			return "", nil, errCallFinished
+		}
+		defer g.leave()
+		if f == nil {
+			return "", nil, errUnavailable
+		}
+		return f(id, hash)
+	}
+}
+
+func (g *guard) getCurrentAccountBalance(f func() (int64, error)) func() (int64, error) {
+	return func() (int64, error) {
+		if !g.enter() {
+			return 0, errCallFinished
+		}
+		defer g.leave()
+		if f == nil {
+			return 0, errUnavailable
+		}
+		return f()
+	}
+}
+
+func (g *guard) sendFromAccount(
+	f func(string, int64) (int64, error),
+) func(string, int64) (int64, error) {
+	return func(target string, msat int64) (int64, error) {
+		if !g.enter() {
+			return 0, errCallFinished
+		}
+		defer g.leave()
+		if f == nil {
+			return 0, errUnavailable
+		}
+		return f(target, msat)
+	}
+}
+
+func (g *guard) holdFunds(
+	f func(string, int64, int64) (string, error),
+) func(string, int64, int64) (string, error) {
+	return func(account string, msat int64, expiry int64) (string, error) {
+		if !g.enter() {
+			return "", errCallFinished
+		}
+		defer g.leave()
+		if f == nil {
+			return "", errUnavailable
+		}
+		return f(account, msat, expiry)
+	}
+}
+
+func (g *guard) captureHold(
+	f func(string, int64) (int64, error),
+) func(string, int64) (int64, error) {
+	return func(id string, msat int64) (int64, error) {
+		if !g.enter() {
+			return 0, errCallFinished
+		}
+		defer g.leave()
+		if f == nil {
+			return 0, errUnavailable
+		}
+		return f(id, msat)
+	}
+}
+
+func (g *guard) releaseHold(f func(string) error) func(string) error {
+	return func(id string) error {
+		if !g.enter() {
+			return errCallFinished
+		}
+		defer g.leave()
+		if f == nil {
+			return errUnavailable
+		}
+		return f(id)
+	}
+}
@@ -0,0 +1,126 @@
+package runlua
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/etleneum/data"
+	"github.com/rs/zerolog"
+)
+
+// callAll calls every callback with zero values and returns the errors they
+// have returned.
+func callAll(cb Callbacks) map[string]error {
+	errs := make(map[string]error)
+	v := reflect.ValueOf(cb)
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		args := make([]reflect.Value, f.Type().NumIn())
+		for j := range args {
+			args[j] = reflect.Zero(f.Type().In(j))
+		}
+		if len(args) > 0 && f.Type().In(0) == reflect.TypeOf(&http.Request{}) {
+			args[0] = reflect.ValueOf(&http.Request{})
+		}
+
+		out := f.Call(args)
+		err, _ := out[len(out)-1].Interface().(error)
+		errs[v.Type().Field(i).Name] = err
+	}
+	return errs
+}
+
+func TestGuard(t *testing.T) {
+	// every callback counts how many times it was called
+	var calls int32
+	var cb Callbacks
+	v := reflect.ValueOf(&cb).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		ft := v.Field(i).Type()
+		v.Field(i).Set(reflect.MakeFunc(ft, func(_ []reflect.Value) []reflect.Value {
+			atomic.AddInt32(&calls, 1)
+			out := make([]reflect.Value, ft.NumOut())
+			for j := range out {
+				out[j] = reflect.Zero(ft.Out(j))
+			}
+			return out
+		}))
+	}
+
+	g := &guard{}
+	guarded := g.wrap(context.Background(), cb)
+	for name, err := range callAll(guarded) {
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+	if int(calls) != v.NumField() {
+		t.Errorf("%d callbacks were called, expected %d", calls, v.NumField())
+	}
+
+	// missing callbacks fail
+	for name, err := range callAll(g.wrap(context.Background(), Callbacks{})) {
+		if err != errUnavailable {
+			t.Errorf("%s: got %v, expected %s", name, err, errUnavailable)
+		}
+	}
+
+	// nothing goes through after the guard is closed
+	g.close()
+	calls = 0
+	for name, err := range callAll(guarded) {
+		if err != errCallFinished {
+			t.Errorf("%s: got %v after close, expected %s", name, err, errCallFinished)
+		}
+	}
+	if calls != 0 {
+		t.Errorf("%d callbacks were called after close", calls)
+	}
+}
+
+func TestCancelRunningCall(t *testing.T) {
+	contract := data.Contract{
+		Id: "ccancel",
+		Code: `
+function spam ()
+  while true do
+    contract.emit('tick', {})
+  end
+end
+`,
+		State: []byte(`{}`),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var emitted int32
+	callbacks := Callbacks{
+		EmitEvent: func(_ string, _ interface{}) error {
+			if atomic.AddInt32(&emitted, 1) == 10 {
+				cancel()
+			}
+			return nil
+		},
+	}
+
+	_, _, _, err := RunCall(ctx, zerolog.Nop(), ioutil.Discard, callbacks, contract,
+		data.Call{Id: "rcancel", ContractId: contract.Id, Method: "spam",
+			Payload: []byte(`{}`), GasLimit: MaxGasLimit})
+	// the hook may stop the lua code before RunCall notices the cancellation
+	if err == nil || !(strings.Contains(err.Error(), "call cancelled") ||
+		strings.Contains(err.Error(), "call interrupted")) {
+		t.Fatalf("expected the call to be cancelled, got %v", err)
+	}
+
+	// the lua state may still be running for a moment, but it can't reach us
+	after := atomic.LoadInt32(&emitted)
+	time.Sleep(100 * time.Millisecond)
+	if now := atomic.LoadInt32(&emitted); now != after {
+		t.Fatalf("%d callbacks ran after the call was cancelled", now-after)
+	}
+}
@@ -2,9 +2,6 @@ package runlua
 
 import (
 	"errors"
-	"fmt"
-	"io/ioutil"
-	"net/http"
 	"net/url"
 	"regexp"
 	"strings"
@@ -14,78 +11,79 @@ import (
 	openpgperrors "golang.org/x/crypto/openpgp/errors"
 )
 
-func lua_keybase_lookup(provider, name string) (username string, err error) {
-	params := url.Values{}
-	params.Set("fields", "basics")
-	params.Set(provider, name)
-	url := "https://keybase.io/_/api/1.0/user/lookup.json"
-	resp, err := http.Get(url + "?" + params.Encode())
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-
-	b, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", err
-	}
+// make_lua_keybase makes the keybase functions on top of the http functions
+// available to contracts, so their requests are limited and recorded with
+// the call like any other.
+func make_lua_keybase(
+	gettext func(string, ...map[string]interface{}) (string, error),
+) (
+	lua_keybase_lookup func(string, string) (string, error),
+	lua_keybase_verify_signature func(string, string, string) (bool, error),
+	lua_keybase_verify_bundle func(string, string) (bool, error),
+) {
+	lua_keybase_lookup = func(provider, name string) (username string, err error) {
+		params := url.Values{}
+		params.Set("fields", "basics")
+		params.Set(provider, name)
+		text, err := gettext("https://keybase.io/_/api/1.0/user/lookup.json?" + params.Encode())
+		if err != nil {
+			return "", err
+		}
 
-	gjson.GetBytes(b, "them").ForEach(func(_, match gjson.Result) bool {
-		username = match.Get("basics.username").String()
-		return false
-	})
+		gjson.Get(text, "them").ForEach(func(_, match gjson.Result) bool {
+			username = match.Get("basics.username").String()
+			return false
+		})
 
-	return username, nil
-}
-
-func lua_keybase_verify_signature(username, text, sig string) (ok bool, err error) {
-	resp, err := http.Get("https://keybase.io/" + username + "/pgp_keys.asc")
-	if err != nil {
-		return false, err
+		return username, nil
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		return false, fmt.Errorf("keybase returned status code %d", resp.StatusCode)
-	}
+	lua_keybase_verify_signature = func(username, text, sig string) (ok bool, err error) {
+		keys, err := gettext("https://keybase.io/" + url.PathEscape(username) + "/pgp_keys.asc")
+		if err != nil {
+			return false, err
+		}
 
-	keyring, err := openpgp.ReadArmoredKeyRing(resp.Body)
-	if err != nil {
-		return false, err
-	}
+		keyring, err := openpgp.ReadArmoredKeyRing(strings.NewReader(keys))
+		if err != nil {
+			return false, err
+		}
 
-	sig, err = getSignatureBlockFromBundle(sig)
-	if err != nil {
-		return false, err
-	}
+		sig, err = getSignatureBlockFromBundle(sig)
+		if err != nil {
+			return false, err
+		}
 
-	verification_target := strings.NewReader(text)
-	signature := strings.NewReader(sig)
+		verification_target := strings.NewReader(text)
+		signature := strings.NewReader(sig)
 
-	_, err = openpgp.CheckArmoredDetachedSignature(keyring, verification_target, signature)
-	if err != nil {
-		if _, ok := err.(openpgperrors.SignatureError); ok {
-			// this means the signature is wrong and not some kind of operational error
-			return false, nil
+		_, err = openpgp.CheckArmoredDetachedSignature(keyring, verification_target, signature)
+		if err != nil {
+			if _, ok := err.(openpgperrors.SignatureError); ok {
+				// this means the signature is wrong and not some kind of operational error
+				return false, nil
+			}
+
+			return false, err
 		}
 
-		return false, err
+		return true, nil
 	}
 
-	return true, nil
-}
+	lua_keybase_verify_bundle = func(username, bundle string) (ok bool, err error) {
+		sig, err := getSignatureBlockFromBundle(bundle)
+		if err != nil {
+			return false, err
+		}
+		text, err := getSignedMessageFromBundle(bundle)
+		if err != nil {
+			return false, err
+		}
 
-func lua_keybase_verify_bundle(username, bundle string) (ok bool, err error) {
-	sig, err := getSignatureBlockFromBundle(bundle)
-	if err != nil {
-		return false, err
-	}
-	text, err := getSignedMessageFromBundle(bundle)
-	if err != nil {
-		return false, err
+		return lua_keybase_verify_signature(username, text, sig)
 	}
 
-	return lua_keybase_verify_signature(username, text, sig)
+	return
 }
 
 func lua_keybase_extract_message(bundle string) (message string) {
@@ -0,0 +1,489 @@
+package runlua
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/fiatjaf/etleneum/data/luaparse"
+)
+
+// LintWarning is something in the contract code that is probably a mistake.
+// it doesn't prevent the contract from being created.
+type LintWarning struct {
+	Line    int    `json:"line"`
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// sandboxGlobals is the shape of sandbox_env: a nested map for each table
+// with known fields and nil for everything else. it is taken from the sandbox
+// code itself so it never gets out of sync.
+var sandboxGlobals = func() map[string]interface{} {
+	globals := make(map[string]interface{})
+
+	block, err := luaparse.Parse(sandboxCode)
+	if err != nil {
+		panic("sandbox code doesn't parse: " + err.Error())
+	}
+	for _, stat := range block.Stats {
+		assign, ok := stat.(*luaparse.Assign)
+		if !ok || len(assign.Targets) != 1 || len(assign.Exprs) != 1 {
+			continue
+		}
+		switch target := assign.Targets[0].(type) {
+		case *luaparse.Name:
+			if table, ok := assign.Exprs[0].(*luaparse.Table); ok &&
+				target.Name == "sandbox_env" {
+				globals = sandboxTable(table)
+			}
+		case *luaparse.Index:
+			if key, ok := target.Key.(*luaparse.String); ok &&
+				lintPath(target.Obj) == "sandbox_env" {
+				globals[key.Value] = nil
+			}
+		}
+	}
+
+	return globals
+}()
+
+func sandboxTable(table *luaparse.Table) map[string]interface{} {
+	fields := make(map[string]interface{})
+	for _, field := range table.Fields {
+		key, ok := field.Key.(*luaparse.String)
+		if !ok {
+			continue
+		}
+		if value, ok := field.Value.(*luaparse.Table); ok {
+			fields[key.Value] = sandboxTable(value)
+		} else {
+			fields[key.Value] = nil
+		}
+	}
+	return fields
+}
+
+// Lint looks for common mistakes in contract code: globals that don't exist
+// in the sandbox, writes to undeclared globals, methods that can't be called,
+// contract.send without checking the funds and account.id without checking
+// if there is a logged user.
+func Lint(code string) ([]LintWarning, error) {
+	block, err := luaparse.Parse(code)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &linter{
+		warnings: []LintWarning{},
+		declared: make(map[string]bool),
+		used:     make(map[string]bool),
+	}
+
+	// the contract's own globals are the ones defined at the top level
+	var functions []*luaparse.Function
+	methodLines := make(map[string]int)
+	for _, stat := range block.Stats {
+		name, fn := lintTopLevelFunction(stat)
+		if name == "" {
+			if assign, ok := stat.(*luaparse.Assign); ok {
+				for _, target := range assign.Targets {
+					if name, ok := target.(*luaparse.Name); ok {
+						l.declared[name.Name] = true
+					}
+				}
+			}
+			continue
+		}
+
+		l.declared[name] = true
+		if previous, ok := methodLines[name]; ok {
+			l.warn(previous, "unreachable-method",
+				"'%s' is defined again at line %d, this definition is never used",
+				name, stat.Line())
+		}
+		functions = append(functions, fn)
+		methodLines[name] = stat.Line()
+	}
+
+	l.block(block, true)
+
+	for name, line := range methodLines {
+		if strings.HasPrefix(name, "_") && name != "__init__" &&
+			name != "__migrate__" && !l.used[name] {
+			l.warn(line, "unreachable-method",
+				"'%s' can't be called directly (it starts with '_') and isn't used anywhere",
+				name)
+		}
+	}
+	for _, fn := range functions {
+		lintSend(l, fn)
+		lintAccount(l, fn)
+	}
+
+	sort.Slice(l.warnings, func(i, j int) bool {
+		if l.warnings[i].Line != l.warnings[j].Line {
+			return l.warnings[i].Line < l.warnings[j].Line
+		}
+		return l.warnings[i].Message < l.warnings[j].Message
+	})
+	return l.warnings, nil
+}
+
+type linter struct {
+	warnings []LintWarning
+	scopes   []map[string]bool
+	declared map[string]bool // globals defined by the contract
+	used     map[string]bool // globals read somewhere
+}
+
+func (l *linter) warn(line int, kind string, message string, args ...interface{}) {
+	l.warnings = append(l.warnings, LintWarning{
+		Line:    line,
+		Kind:    kind,
+		Message: fmt.Sprintf(message, args...),
+	})
+}
+
+func (l *linter) push(names ...string) {
+	scope := make(map[string]bool, len(names))
+	for _, name := range names {
+		scope[name] = true
+	}
+	l.scopes = append(l.scopes, scope)
+}
+
+func (l *linter) pop() { l.scopes = l.scopes[:len(l.scopes)-1] }
+
+func (l *linter) declare(names ...string) {
+	for _, name := range names {
+		l.scopes[len(l.scopes)-1][name] = true
+	}
+}
+
+func (l *linter) isLocal(name string) bool {
+	for i := len(l.scopes) - 1; i >= 0; i-- {
+		if l.scopes[i][name] {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *linter) block(block *luaparse.Block, topLevel bool) {
+	l.push()
+	for _, stat := range block.Stats {
+		l.stat(stat, topLevel)
+	}
+	l.pop()
+}
+
+func (l *linter) stat(node luaparse.Node, topLevel bool) {
+	switch n := node.(type) {
+	case *luaparse.Local:
+		l.exprs(n.Exprs)
+		l.declare(n.Names...)
+	case *luaparse.LocalFunction:
+		l.declare(n.Name)
+		l.function(n.Func)
+	case *luaparse.FunctionStat:
+		if len(n.Path) == 1 && n.Method == "" {
+			l.write(n.Line(), n.Path[0], topLevel, true)
+		} else {
+			l.read(n.Path[0], n.Line())
+		}
+		if n.Method != "" {
+			l.push("self")
+			l.function(n.Func)
+			l.pop()
+		} else {
+			l.function(n.Func)
+		}
+	case *luaparse.Assign:
+		l.exprs(n.Exprs)
+		for _, target := range n.Targets {
+			switch t := target.(type) {
+			case *luaparse.Name:
+				fname, _ := lintTopLevelFunction(n)
+				l.write(t.Line(), t.Name, topLevel, fname != "")
+			case *luaparse.Index:
+				l.expr(t.Obj)
+				l.expr(t.Key)
+			default:
+				l.expr(t)
+			}
+		}
+	case *luaparse.CallStat:
+		l.expr(n.Call)
+	case *luaparse.Do:
+		l.block(n.Body, false)
+	case *luaparse.While:
+		l.expr(n.Cond)
+		l.block(n.Body, false)
+	case *luaparse.Repeat:
+		// the condition can see the locals of the body
+		l.push()
+		for _, stat := range n.Body.Stats {
+			l.stat(stat, false)
+		}
+		l.expr(n.Cond)
+		l.pop()
+	case *luaparse.If:
+		for i := range n.Conds {
+			l.expr(n.Conds[i])
+			l.block(n.Blocks[i], false)
+		}
+		if n.Else != nil {
+			l.block(n.Else, false)
+		}
+	case *luaparse.NumFor:
+		l.expr(n.Start)
+		l.expr(n.Limit)
+		l.expr(n.Step)
+		l.push(n.Var)
+		l.block(n.Body, false)
+		l.pop()
+	case *luaparse.GenFor:
+		l.exprs(n.Exprs)
+		l.push(n.Names...)
+		l.block(n.Body, false)
+		l.pop()
+	case *luaparse.Return:
+		l.exprs(n.Exprs)
+	}
+}
+
+func (l *linter) write(line int, name string, topLevel bool, isFunction bool) {
+	switch {
+	case l.isLocal(name):
+	case topLevel:
+		if _, ok := sandboxGlobals[name]; ok {
+			l.warn(line, "global-write",
+				"'%s' is a sandbox global, assigning to it hides the original", name)
+		}
+	case l.declared[name]:
+	case isFunction:
+		l.warn(line, "unreachable-method",
+			"'%s' is not defined at the top level so it can't be called as a method",
+			name)
+	default:
+		l.warn(line, "global-write",
+			"assignment to undeclared global '%s', use 'local' or contract.state", name)
+	}
+}
+
+func (l *linter) function(fn *luaparse.Function) {
+	l.push(fn.Params...)
+	l.block(fn.Body, false)
+	l.pop()
+}
+
+func (l *linter) exprs(nodes []luaparse.Node) {
+	for _, node := range nodes {
+		l.expr(node)
+	}
+}
+
+func (l *linter) expr(node luaparse.Node) {
+	switch n := node.(type) {
+	case *luaparse.Name:
+		l.read(n.Name, n.Line())
+	case *luaparse.Index:
+		if fields, ok := l.sandboxFields(n.Obj); ok {
+			if key, ok := n.Key.(*luaparse.String); ok {
+				if _, exists := fields[key.Value]; !exists {
+					l.warn(n.Line(), "unknown-global",
+						"'%s.%s' doesn't exist in the sandbox", lintPath(n.Obj), key.Value)
+				}
+			}
+		}
+		l.expr(n.Obj)
+		l.expr(n.Key)
+	case *luaparse.Call:
+		l.expr(n.Fn)
+		l.exprs(n.Args)
+	case *luaparse.MethodCall:
+		l.expr(n.Obj)
+		l.exprs(n.Args)
+	case *luaparse.Function:
+		l.function(n)
+	case *luaparse.Table:
+		for _, field := range n.Fields {
+			l.expr(field.Key)
+			l.expr(field.Value)
+		}
+	case *luaparse.BinOp:
+		l.expr(n.L)
+		l.expr(n.R)
+	case *luaparse.UnOp:
+		l.expr(n.X)
+	case *luaparse.Paren:
+		l.expr(n.X)
+	}
+}
+
+func (l *linter) read(name string, line int) {
+	if l.isLocal(name) {
+		return
+	}
+	l.used[name] = true
+	if _, ok := sandboxGlobals[name]; ok || l.declared[name] {
+		return
+	}
+	l.warn(line, "unknown-global", "'%s' is not defined in the sandbox", name)
+}
+
+// sandboxFields returns the known fields of node if it is one of the sandbox
+// tables, like contract or contract.storage.
+func (l *linter) sandboxFields(node luaparse.Node) (map[string]interface{}, bool) {
+	switch n := node.(type) {
+	case *luaparse.Name:
+		if l.isLocal(n.Name) || l.declared[n.Name] {
+			return nil, false
+		}
+		fields, ok := sandboxGlobals[n.Name].(map[string]interface{})
+		return fields, ok
+	case *luaparse.Index:
+		parent, ok := l.sandboxFields(n.Obj)
+		key, isString := n.Key.(*luaparse.String)
+		if !ok || !isString {
+			return nil, false
+		}
+		fields, ok := parent[key.Value].(map[string]interface{})
+		return fields, ok
+	}
+	return nil, false
+}
+
+// lintSend warns about contract.send calls in functions that never look at
+// contract.get_funds.
+func lintSend(l *linter, fn *luaparse.Function) {
+	var sends []int
+	checked := false
+	luaparse.Walk(fn.Body, func(node luaparse.Node) bool {
+		if call, ok := node.(*luaparse.Call); ok {
+			switch lintPath(call.Fn) {
+			case "contract.send":
+				sends = append(sends, call.Line())
+			case "contract.get_funds":
+				checked = true
+			}
+		}
+		return true
+	})
+
+	if checked {
+		return
+	}
+	for _, line := range sends {
+		l.warn(line, "unchecked-send",
+			"contract.send is called without checking contract.get_funds() first")
+	}
+}
+
+// lintAccount warns about functions that use account.id without ever checking
+// it in a condition, it is nil when the call is made without a logged user.
+func lintAccount(l *linter, fn *luaparse.Function) {
+	first := 0
+	aliases := make(map[string]bool)
+	luaparse.Walk(fn.Body, func(node luaparse.Node) bool {
+		switch n := node.(type) {
+		case *luaparse.Index:
+			if lintPath(n) == "account.id" && first == 0 {
+				first = n.Line()
+			}
+		case *luaparse.Local:
+			for i, expr := range n.Exprs {
+				if i < len(n.Names) && lintPath(expr) == "account.id" {
+					aliases[n.Names[i]] = true
+				}
+			}
+		}
+		return true
+	})
+	if first == 0 {
+		return
+	}
+
+	mentionsAccount := func(node luaparse.Node) (found bool) {
+		luaparse.Walk(node, func(node luaparse.Node) bool {
+			if lintPath(node) == "account.id" {
+				found = true
+			} else if name, ok := node.(*luaparse.Name); ok && aliases[name.Name] {
+				found = true
+			}
+			return !found
+		})
+		return found
+	}
+
+	checked := false
+	luaparse.Walk(fn.Body, func(node luaparse.Node) bool {
+		var conds []luaparse.Node
+		switch n := node.(type) {
+		case *luaparse.If:
+			conds = n.Conds
+		case *luaparse.While:
+			conds = []luaparse.Node{n.Cond}
+		case *luaparse.Repeat:
+			conds = []luaparse.Node{n.Cond}
+		case *luaparse.BinOp:
+			switch n.Op {
+			case "and", "or", "==", "~=":
+				conds = []luaparse.Node{n}
+			}
+		case *luaparse.UnOp:
+			if n.Op == "not" {
+				conds = []luaparse.Node{n}
+			}
+		}
+		for _, cond := range conds {
+			if mentionsAccount(cond) {
+				checked = true
+			}
+		}
+		return !checked
+	})
+
+	if !checked {
+		l.warn(first, "unchecked-account",
+			"account.id is used without checking if it's nil (when there's no logged user)")
+	}
+}
+
+// lintTopLevelFunction returns the name and the function of statements like
+// `function name ()` and `name = function ()`.
+func lintTopLevelFunction(stat luaparse.Node) (string, *luaparse.Function) {
+	switch n := stat.(type) {
+	case *luaparse.FunctionStat:
+		if len(n.Path) == 1 && n.Method == "" {
+			return n.Path[0], n.Func
+		}
+	case *luaparse.Assign:
+		if len(n.Targets) == 1 && len(n.Exprs) == 1 {
+			name, isName := n.Targets[0].(*luaparse.Name)
+			fn, isFunction := n.Exprs[0].(*luaparse.Function)
+			if isName && isFunction {
+				return name.Name, fn
+			}
+		}
+	}
+	return "", nil
+}
+
+// lintPath turns a.b.c into "a.b.c", or "" if node is something else.
+func lintPath(node luaparse.Node) string {
+	switch n := node.(type) {
+	case *luaparse.Name:
+		return n.Name
+	case *luaparse.Index:
+		key, ok := n.Key.(*luaparse.String)
+		if !ok {
+			return ""
+		}
+		if obj := lintPath(n.Obj); obj != "" {
+			return obj + "." + key.Value
+		}
+	}
+	return ""
+}
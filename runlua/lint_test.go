@@ -0,0 +1,162 @@
+package runlua
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestSandboxGlobals(t *testing.T) {
+	for _, path := range [][]string{
+		{"contract", "state"},
+		{"contract", "send"},
+		{"contract", "storage", "keys"},
+		{"account", "id"},
+		{"util", "json_encode"},
+		{"util", "random_bytes"},
+		{"keybase", "verify"},
+		{"string", "format"},
+		{"math", "floor"},
+		{"os", "time"},
+		{"pairs"},
+		{"require"},
+	} {
+		var fields interface{} = sandboxGlobals
+		for _, key := range path {
+			table, ok := fields.(map[string]interface{})
+			if !ok {
+				t.Errorf("%v: %s is not a table", path, key)
+				break
+			}
+			if fields, ok = table[key]; !ok {
+				t.Errorf("%v: %s not found", path, key)
+				break
+			}
+		}
+	}
+
+	for _, name := range []string{"io", "debug", "load", "dofile", "setmetatable"} {
+		if _, ok := sandboxGlobals[name]; ok {
+			t.Errorf("%s shouldn't be in the sandbox", name)
+		}
+	}
+}
+
+func TestLint(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		code     string
+		expected []string // line:kind
+	}{
+		{
+			"sandbox globals",
+			`function __init__ ()
+  return {n=0, t=os.time(), s=string.format('%d', math.floor(1.5))}
+end
+
+function f ()
+  for k, v in pairs(contract.state) do util.print(k, v) end
+  contract.storage.set('x', util.json_encode({1}))
+  if account.id then contract.state.n = tonumber(call.payload.n) end
+end`,
+			nil,
+		},
+		{
+			"undefined globals",
+			`function f ()
+  foo()
+  contract.state.x = contract.stat
+  return util.nope(bar)
+end`,
+			[]string{"2:unknown-global", "3:unknown-global", "4:unknown-global", "4:unknown-global"},
+		},
+		{
+			"contract globals",
+			`helper = function (x) return x end
+limit = 10
+
+function f ()
+  return helper(limit)
+end`,
+			nil,
+		},
+		{
+			"global writes",
+			`string = 1
+
+function f ()
+  total = 1
+end`,
+			[]string{"1:global-write", "4:global-write"},
+		},
+		{
+			"shadowing",
+			`local contract = {}
+function f (util, ...)
+  local account = {}
+  contract.whatever()
+  util.unknown()
+  account.thing = 1
+  for string in pairs({}) do string.nope() end
+  local x
+  x = 1
+  repeat local y = x until y
+end`,
+			nil,
+		},
+		{
+			"locals don't leak out of their blocks",
+			`function f ()
+  do local x = 1 end
+  return x
+end`,
+			[]string{"3:unknown-global"},
+		},
+		{
+			"unchecked send and account",
+			`function pay ()
+  contract.send(account.id, 1000)
+end
+
+function pay_checked ()
+  if not account.id then error('no account') end
+  if contract.get_funds() < 1000 then error('no funds') end
+  contract.send(account.id, 1000)
+end`,
+			[]string{"2:unchecked-account", "2:unchecked-send"},
+		},
+		{
+			"unreachable methods",
+			`function f () end
+function f () end
+function _private () end
+function _used () end
+
+function g ()
+  function inner () end
+  return _used()
+end`,
+			[]string{"1:unreachable-method", "3:unreachable-method", "7:unreachable-method"},
+		},
+	} {
+		warnings, err := Lint(tc.code)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+
+		var got []string
+		for _, w := range warnings {
+			got = append(got, fmt.Sprintf("%d:%s", w.Line, w.Kind))
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s: got %v, expected %v (%v)", tc.name, got, tc.expected, warnings)
+		}
+	}
+}
+
+func TestLintSyntaxError(t *testing.T) {
+	if _, err := Lint("function f ("); err == nil {
+		t.Error("expected a syntax error")
+	}
+}
@@ -0,0 +1,137 @@
+package runlua
+
+/*
+#include <stdint.h>
+#include <stdlib.h>
+
+typedef struct lua_State lua_State;
+typedef int (*lua_CFunction) (lua_State *L);
+typedef intptr_t lua_KContext;
+typedef int (*lua_KFunction) (lua_State *L, int status, lua_KContext ctx);
+typedef void *(*lua_Alloc) (void *ud, void *ptr, size_t osize, size_t nsize);
+
+void lua_setallocf (lua_State *L, lua_Alloc f, void *ud);
+lua_Alloc lua_getallocf (lua_State *L, void **ud);
+int lua_getfield (lua_State *L, int idx, const char *k);
+void lua_setfield (lua_State *L, int idx, const char *k);
+lua_CFunction lua_tocfunction (lua_State *L, int idx);
+void lua_pushcclosure (lua_State *L, lua_CFunction fn, int n);
+void lua_callk (lua_State *L, int nargs, int nresults, lua_KContext ctx, lua_KFunction k);
+void lua_rotate (lua_State *L, int idx, int n);
+int lua_gettop (lua_State *L);
+void lua_settop (lua_State *L, int idx);
+
+typedef struct {
+	long long used;
+	long long limit;
+	int exceeded;
+	int in_go; // how many go functions are running right now
+	lua_CFunction call_go;
+} bounded_alloc_state;
+
+static void *bounded_alloc(void *ud, void *ptr, size_t osize, size_t nsize) {
+	bounded_alloc_state *st = (bounded_alloc_state *)ud;
+
+	// when ptr is NULL osize is the type of the object being created
+	long long current = ptr == NULL ? 0 : (long long)osize;
+
+	if (nsize == 0) {
+		free(ptr);
+		st->used -= current;
+		return NULL;
+	}
+
+	if ((long long)nsize > current && st->used - current + (long long)nsize > st->limit) {
+		st->exceeded = 1;
+
+		// a lua memory error longjmps to the closest pcall, and inside a go
+		// function that would jump over go frames. there we let the allocation
+		// go through and the next one made by lua itself fails instead.
+		if (st->in_go == 0) {
+			return NULL;
+		}
+	}
+
+	void *nptr = realloc(ptr, nsize);
+	if (nptr != NULL) {
+		st->used += (long long)nsize - current;
+	}
+	return nptr;
+}
+
+// replaces the __call of go functions so we know when we're inside one.
+static int guarded_call(lua_State *L) {
+	void *ud;
+	lua_getallocf(L, &ud);
+	bounded_alloc_state *st = (bounded_alloc_state *)ud;
+
+	int nargs = lua_gettop(L) - 1;
+	lua_pushcclosure(L, st->call_go, 0);
+	lua_rotate(L, 1, 1);
+
+	// errors in go functions are go panics that unwind through here and end
+	// the whole run, so there's no need to restore in_go for those.
+	st->in_go++;
+	lua_callk(L, nargs + 1, -1, 0, NULL);
+	st->in_go--;
+
+	return lua_gettop(L);
+}
+
+static void set_bounded_alloc(uintptr_t l, int registry, bounded_alloc_state *st) {
+	lua_State *L = (lua_State *)l;
+
+	lua_setallocf(L, bounded_alloc, st);
+
+	lua_getfield(L, registry, "GoLua.GoFunction");
+	lua_getfield(L, -1, "__call");
+	st->call_go = lua_tocfunction(L, -1);
+	lua_settop(L, -2);
+	lua_pushcclosure(L, guarded_call, 0);
+	lua_setfield(L, -2, "__call");
+	lua_settop(L, -2);
+}
+*/
+import "C"
+
+import (
+	"unsafe"
+
+	"github.com/aarzilli/golua/lua"
+)
+
+// MemoryLimit is the maximum number of bytes a single call can have allocated
+// at any given time.
+var MemoryLimit int64 = 64 << 20
+
+type memoryLimiter struct {
+	st *C.bounded_alloc_state
+}
+
+// limitMemory replaces the allocator of the given lua state with one that
+// fails when more than limit bytes are in use. free() must only be called
+// after the lua state is closed.
+//
+// the allocator is in C because lua.State.SetAllocf hands lua the address of
+// a Go func value that nothing else keeps alive.
+func limitMemory(L *lua.State, limit int64) memoryLimiter {
+	st := (*C.bounded_alloc_state)(C.calloc(1, C.size_t(unsafe.Sizeof(C.bounded_alloc_state{}))))
+	st.used = C.longlong(L.GC(lua.LUA_GCCOUNT, 0))*1024 + C.longlong(L.GC(lua.LUA_GCCOUNTB, 0))
+	st.limit = C.longlong(limit)
+
+	// a thread is the only value whose pointer is its lua_State
+	L.PushThread()
+	ls := L.ToPointer(-1)
+	L.Pop(1)
+	C.set_bounded_alloc(C.uintptr_t(ls), C.int(lua.LUA_REGISTRYINDEX), st)
+
+	return memoryLimiter{st}
+}
+
+func (m memoryLimiter) exceeded() bool {
+	return m.st.exceeded != 0
+}
+
+func (m memoryLimiter) free() {
+	C.free(unsafe.Pointer(m.st))
+}
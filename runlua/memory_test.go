@@ -0,0 +1,50 @@
+package runlua
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/fiatjaf/etleneum/data"
+	"github.com/rs/zerolog"
+)
+
+func TestMemoryLimitInsideGoFunction(t *testing.T) {
+	defer func(limit int64) { MemoryLimit = limit }(MemoryLimit)
+	MemoryLimit = 4 << 20
+
+	contract := data.Contract{
+		Id: "cmemory",
+		Code: `
+function fill ()
+  local big = string.rep('x', 3 << 20)
+  return util.json_encode({big, big})
+end
+
+function small ()
+  return util.json_encode({a = 1})
+end
+`,
+		State: []byte(`{}`),
+	}
+
+	// the go function pushes a string bigger than what is left, which must
+	// fail the call and not the process
+	_, _, _, err := RunCall(context.Background(), zerolog.Nop(), ioutil.Discard,
+		Callbacks{}, contract,
+		data.Call{Id: "r1", ContractId: contract.Id, Method: "fill", Payload: []byte(`{}`)})
+	if err == nil || !strings.Contains(err.Error(), "memory limit exceeded") {
+		t.Fatalf("expected memory limit error, got %v", err)
+	}
+
+	_, returned, _, err := RunCall(context.Background(), zerolog.Nop(), ioutil.Discard,
+		Callbacks{}, contract,
+		data.Call{Id: "r2", ContractId: contract.Id, Method: "small", Payload: []byte(`{}`)})
+	if err != nil {
+		t.Fatalf("call after the memory error failed: %s", err)
+	}
+	if returned != `{"a":1}` {
+		t.Fatalf("unexpected result %v", returned)
+	}
+}
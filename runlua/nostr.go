@@ -0,0 +1,168 @@
+package runlua
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type nostrEvent struct {
+	Id        string     `json:"id"`
+	Pubkey    string     `json:"pubkey"`
+	CreatedAt int64      `json:"created_at"`
+	Kind      int64      `json:"kind"`
+	Tags      [][]string `json:"tags"`
+	Content   string     `json:"content"`
+	Sig       string     `json:"sig"`
+}
+
+// lua_nostr_verify takes an event either as a table or as a JSON string and
+// checks both that its id matches its contents and that it is signed by
+// its pubkey.
+func lua_nostr_verify(event interface{}) (ok bool, err error) {
+	evt, err := parseNostrEvent(event)
+	if err != nil {
+		return false, err
+	}
+
+	id := sha256.Sum256(serializeNostrEvent(evt))
+	if hex.EncodeToString(id[:]) != strings.ToLower(evt.Id) {
+		return false, nil
+	}
+
+	return lua_verify_schnorr(evt.Pubkey, evt.Id, evt.Sig)
+}
+
+func parseNostrEvent(event interface{}) (evt nostrEvent, err error) {
+	var j []byte
+	switch v := event.(type) {
+	case string:
+		j = []byte(v)
+	case map[string]interface{}:
+		// lunatico gives us empty tables as objects
+		if tags, ok := v["tags"].(map[string]interface{}); ok && len(tags) == 0 {
+			v["tags"] = []interface{}{}
+		}
+		j, err = json.Marshal(v)
+		if err != nil {
+			return
+		}
+	default:
+		return evt, errors.New("event must be a table or a JSON string")
+	}
+
+	// numbers coming from lua are always floats
+	var raw struct {
+		nostrEvent
+		CreatedAt float64 `json:"created_at"`
+		Kind      float64 `json:"kind"`
+	}
+	err = json.Unmarshal(j, &raw)
+	if err != nil {
+		return evt, fmt.Errorf("invalid event: %w", err)
+	}
+	evt = raw.nostrEvent
+	evt.CreatedAt = int64(raw.CreatedAt)
+	evt.Kind = int64(raw.Kind)
+	if evt.Tags == nil {
+		evt.Tags = [][]string{}
+	}
+	return evt, nil
+}
+
+// serializeNostrEvent follows NIP-01 exactly, which is not the same as
+// encoding/json because of how strings are escaped.
+func serializeNostrEvent(evt nostrEvent) []byte {
+	b := new(bytes.Buffer)
+	b.WriteString(`[0,"`)
+	b.WriteString(strings.ToLower(evt.Pubkey))
+	b.WriteString(`",`)
+	b.WriteString(strconv.FormatInt(evt.CreatedAt, 10))
+	b.WriteString(`,`)
+	b.WriteString(strconv.FormatInt(evt.Kind, 10))
+	b.WriteString(`,[`)
+	for i, tag := range evt.Tags {
+		if i > 0 {
+			b.WriteString(`,`)
+		}
+		b.WriteString(`[`)
+		for j, item := range tag {
+			if j > 0 {
+				b.WriteString(`,`)
+			}
+			writeNostrString(b, item)
+		}
+		b.WriteString(`]`)
+	}
+	b.WriteString(`],`)
+	writeNostrString(b, evt.Content)
+	b.WriteString(`]`)
+	return b.Bytes()
+}
+
+func writeNostrString(b *bytes.Buffer, s string) {
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\f':
+			b.WriteString(`\f`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(b, `\u%04x`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+}
+
+// make_lua_nostr_lookup resolves NIP-05 identifiers using the same http
+// functions available to contracts, so lookups can be mocked like any
+// other request.
+func make_lua_nostr_lookup(
+	getjson func(string, ...map[string]interface{}) (interface{}, error),
+) func(string) (string, error) {
+	return func(identifier string) (pubkey string, err error) {
+		name := "_"
+		domain := identifier
+		if spl := strings.SplitN(identifier, "@", 2); len(spl) == 2 {
+			name = strings.ToLower(spl[0])
+			domain = spl[1]
+		}
+		if domain == "" || strings.ContainsAny(domain, "/?#") {
+			return "", errors.New("invalid nip05 identifier")
+		}
+
+		resp, err := getjson("https://" + domain +
+			"/.well-known/nostr.json?name=" + url.QueryEscape(name))
+		if err != nil {
+			return "", err
+		}
+
+		if obj, ok := resp.(map[string]interface{}); ok {
+			if names, ok := obj["names"].(map[string]interface{}); ok {
+				pubkey, _ = names[name].(string)
+			}
+		}
+		return pubkey, nil
+	}
+}
@@ -0,0 +1,65 @@
+package runlua
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// signed with the key from the second BIP-340 test vector. the id and the
+// signature were computed with the BIP-340 reference code and python's json
+// module, independently of the code being tested.
+const nostrTestEvent = `{
+  "id": "9589ae5bb24fdf884092240ed4fcdbffacb22c6d4904e0c3ae6316664f349bae",
+  "pubkey": "dff1d77f2a671c5f36183726db2341be58feae1da2deced843240f7b502ba659",
+  "created_at": 1700000000,
+  "kind": 1,
+  "tags": [
+    ["e", "5c83da77af1dec6d7289834998ad7aafbd9e2191396d75ec3cc27f5a77226f36", "wss://relay.example.com"],
+    ["p", "dff1d77f2a671c5f36183726db2341be58feae1da2deced843240f7b502ba659"]
+  ],
+  "content": "hello \"etleneum\"\nwith a\ttab, a \\ backslash and unicode: çã ⚡",
+  "sig": "edd7bdea9d0723ee5128b0594d9955b405774e1e73c47ef0fbb7a0241790876f6710cf6dc0a3422090d9d61ab1f086a904043e96f50a8b3dff4b840c85d8d49c"
+}`
+
+func TestSerializeNostrEvent(t *testing.T) {
+	evt, err := parseNostrEvent(nostrTestEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `[0,"dff1d77f2a671c5f36183726db2341be58feae1da2deced843240f7b502ba659",1700000000,1,[["e","5c83da77af1dec6d7289834998ad7aafbd9e2191396d75ec3cc27f5a77226f36","wss://relay.example.com"],["p","dff1d77f2a671c5f36183726db2341be58feae1da2deced843240f7b502ba659"]],"hello \"etleneum\"\nwith a\ttab, a \\ backslash and unicode: çã ⚡"]`
+	if got := string(serializeNostrEvent(evt)); got != expected {
+		t.Fatalf("got %s\nexpected %s", got, expected)
+	}
+}
+
+func TestNostrVerify(t *testing.T) {
+	// as lua would give it to us
+	var table map[string]interface{}
+	json.Unmarshal([]byte(nostrTestEvent), &table)
+
+	for _, tc := range []struct {
+		name     string
+		event    interface{}
+		expected bool
+	}{
+		{"json", nostrTestEvent, true},
+		{"table", table, true},
+		{"uppercase id", strings.Replace(nostrTestEvent, "9589ae5b", "9589AE5B", 1), true},
+		{"changed content", strings.Replace(nostrTestEvent, "hello", "hellO", 1), false},
+		{"changed kind", strings.Replace(nostrTestEvent, `"kind": 1`, `"kind": 7`, 1), false},
+		{"changed signature", strings.Replace(nostrTestEvent, `"sig": "edd7`, `"sig": "edd8`, 1), false},
+	} {
+		ok, err := lua_nostr_verify(tc.event)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+		} else if ok != tc.expected {
+			t.Errorf("%s: got %v, expected %v", tc.name, ok, tc.expected)
+		}
+	}
+
+	if _, err := lua_nostr_verify(42); err == nil {
+		t.Error("expected an error for an invalid event")
+	}
+}
@@ -1,6 +1,7 @@
 package runlua
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,84 +12,174 @@ import (
 	"github.com/aarzilli/golua/lua"
 	"github.com/fiatjaf/etleneum/data"
 	"github.com/fiatjaf/lunatico"
-	"github.com/lucsky/cuid"
 	"github.com/rs/zerolog"
 )
 
-var log zerolog.Logger
+// MaxGasLimit is the biggest gas budget a single call can have, each unit of
+// gas corresponds to one instruction executed by the Lua VM.
+var MaxGasLimit int64 = 10000000
+
+// gas is metered in steps of this many instructions
+const gasStep = 100
+
+// Callbacks are the functions through which a contract reaches everything
+// outside its Lua VM. The ones left nil fail when the contract uses them.
+type Callbacks struct {
+	MakeRequest              func(*http.Request) (*http.Response, error)
+	GetExternalContractData  func(id string) (state interface{}, funds int64, err error)
+	CallExternalMethod       func(contract, method string, payload interface{}, msatoshi int64, gasLimit int64) (result interface{}, gasUsed int64, err error)
+	QueryExternalMethod      func(contract, method string, payload interface{}, gasLimit int64) (result interface{}, gasUsed int64, err error)
+	GetContractFunds         func() (int64, error)
+	SendFromContract         func(target string, msat int64) (int64, error)
+	EmitEvent                func(name string, data interface{}) error
+	ScheduleCall             func(method string, payload interface{}, at int64) (string, error)
+	GetRandomBytes           func(n int) (string, error)
+	GetStorage               func(key string) (interface{}, error)
+	SetStorage               func(key string, value interface{}) error
+	DeleteStorage            func(key string) error
+	ListStorageKeys          func(prefix string) ([]string, error)
+	GetLibraryCode           func(id string, hash string) (code string, libraries map[string]string, err error)
+	GetCurrentAccountBalance func() (int64, error)
+	SendFromAccount          func(target string, msat int64) (int64, error)
+	HoldFunds                func(account string, msat int64, expiry int64) (string, error)
+	CaptureHold              func(id string, msat int64) (int64, error)
+	ReleaseHold              func(id string) error
+}
 
 func RunCall(
+	ctx context.Context,
 	logger zerolog.Logger,
 	printToDestination io.Writer,
-	makeRequest func(*http.Request) (*http.Response, error),
-	getExternalContractData func(string) (interface{}, int64, error),
-	callExternalMethod func(string, string, interface{}, int64) error,
-	getContractFunds func() (int64, error),
-	sendFromContract func(target string, sats int64) (int64, error),
-	getCurrentAccountBalance func() (int64, error),
+	callbacks Callbacks,
 	contract data.Contract,
 	call data.Call,
-) (stateAfter interface{}, err error) {
-	log = logger
-	completedOk := make(chan bool, 1)
-	failed := make(chan error, 1)
+) (stateAfter interface{}, returned interface{}, gasUsed int64, err error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*15)
+	defer cancel()
+
+	// every callback goes through the guard so none of them can run after
+	// we've returned, even if the lua state is still alive at that point.
+	g := &guard{}
+
+	type result struct {
+		stateAfter interface{}
+		returned   interface{}
+		gasUsed    int64
+		err        error
+	}
+	done := make(chan result, 1)
 
 	go func() {
-		stateAfter, err = runCall(
-			printToDestination,
-			makeRequest,
-			getExternalContractData,
-			callExternalMethod,
-			getContractFunds,
-			sendFromContract,
-			getCurrentAccountBalance,
+		stateAfter, returned, gasUsed, err := runCall(
+			ctx,
+			logger,
+			g.writer(printToDestination),
+			g.wrap(ctx, callbacks),
 			contract,
 			call,
 		)
-		if err != nil {
-			failed <- err
-			return
-		}
-
-		completedOk <- true
+		done <- result{stateAfter, returned, gasUsed, err}
 	}()
 
 	select {
-	case <-completedOk:
-		return
-	case failure := <-failed:
-		err = failure
-		return
-	case <-time.After(time.Second * 15):
-		err = errors.New("timeout!")
-		return
+	case res := <-done:
+		return res.stateAfter, res.returned, res.gasUsed, res.err
+	case <-ctx.Done():
+		// waits for any callback that may be running right now.
+		// the lua state will be interrupted by the hook and closed soon.
+		g.close()
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, nil, 0, errors.New("timeout!")
+		}
+		return nil, nil, 0, errors.New("call cancelled")
 	}
 }
 
 func runCall(
+	ctx context.Context,
+	logger zerolog.Logger,
 	printToDestination io.Writer,
-	makeRequest func(*http.Request) (*http.Response, error),
-	getExternalContractData func(string) (interface{}, int64, error),
-	callExternalMethod func(string, string, interface{}, int64) error,
-	getContractFunds func() (int64, error),
-	sendFromContract func(target string, sats int64) (int64, error),
-	getCurrentAccountBalance func() (int64, error),
+	cb Callbacks,
 	contract data.Contract,
 	call data.Call,
-) (stateAfter interface{}, err error) {
+) (stateAfter interface{}, returned interface{}, gasUsed int64, err error) {
 	// init lua
 	L := lua.NewState()
-	defer L.Close()
+	mem := limitMemory(L, MemoryLimit)
+	defer func() {
+		L.Close()
+		mem.free()
+	}()
 	L.OpenLibs()
 
 	initialFunds := contract.Funds + call.Msatoshi
 
-	lua_http_gettext, lua_http_getjson, lua_http_postjson, _ := make_lua_http(makeRequest)
+	gasLimit := call.GasLimit
+	if gasLimit <= 0 || gasLimit > MaxGasLimit {
+		gasLimit = MaxGasLimit
+	}
+	meterGas := func() error {
+		if ctx.Err() != nil {
+			return errors.New("call interrupted")
+		}
+
+		gasUsed += gasStep
+		if gasUsed > gasLimit {
+			return errors.New("out of gas!")
+		}
+		return nil
+	}
+
+	// calls and queries to other contracts run with the gas this call has
+	// left and what they use is added to it
+	runExternal := func(f func(gasLimit int64) (interface{}, int64, error)) (interface{}, error) {
+		if gasUsed >= gasLimit {
+			return nil, errors.New("out of gas!")
+		}
+		result, used, err := f(gasLimit - gasUsed)
+		gasUsed += used
+		if err != nil {
+			return nil, err
+		}
+		if gasUsed > gasLimit {
+			return nil, errors.New("out of gas!")
+		}
+		return result, nil
+	}
+	callExternalMethod := func(contract, method string, payload interface{}, msatoshi int64) (interface{}, error) {
+		return runExternal(func(gasLimit int64) (interface{}, int64, error) {
+			return cb.CallExternalMethod(contract, method, payload, msatoshi, gasLimit)
+		})
+	}
+	queryExternalMethod := func(contract, method string, payload interface{}) (interface{}, error) {
+		return runExternal(func(gasLimit int64) (interface{}, int64, error) {
+			return cb.QueryExternalMethod(contract, method, payload, gasLimit)
+		})
+	}
+
+	// time and randomness are fixed for each call so it can be reproduced
+	callTime := call.Time
+	if callTime.IsZero() {
+		callTime = time.Now()
+	}
+	random := callRandom(contract.Id, call.Id)
+
+	lua_http_gettext, lua_http_getjson, lua_http_postjson, _ := make_lua_http(logger, cb.MakeRequest)
+	lua_nostr_lookup := make_lua_nostr_lookup(lua_http_getjson)
+	lua_keybase_lookup, lua_keybase_verify_signature, lua_keybase_verify_bundle :=
+		make_lua_keybase(lua_http_gettext)
+	lua_storage_get, lua_storage_set, lua_storage_delete := make_lua_storage(
+		cb.GetStorage, cb.SetStorage, cb.DeleteStorage)
 	var lua_current_account interface{}
 	if call.Caller != "" {
 		lua_current_account = call.Caller
 	}
 
+	var lua_contract_owner interface{}
+	if contract.Owner != "" {
+		lua_contract_owner = contract.Owner
+	}
+
 	var currentstate map[string]interface{}
 	err = json.Unmarshal(contract.State, &currentstate)
 	if err != nil {
@@ -102,14 +193,21 @@ func runCall(
 	}
 
 	// run the code
-	log.Debug().Str("method", call.Method).
+	logger.Debug().Str("method", call.Method).
 		Str("caller", call.Caller).
 		Int64("msatoshi", call.Msatoshi).
 		Interface("payload", payload).
 		Int64("funds", initialFunds).
+		Int64("gas", gasLimit).
 		Msg("running code")
 
 	actualCode := contract.Code + "\nreturn " + call.Method + "()"
+	if call.Method == "__migrate__" {
+		// upgrades keep the state as it is if there is nothing to migrate
+		actualCode = contract.Code + "\n" +
+			"if __migrate__ then return __migrate__(contract.state) or contract.state end\n" +
+			"return contract.state"
+	}
 
 	// globals
 	lunatico.SetGlobals(L, map[string]interface{}{
@@ -120,12 +218,26 @@ func runCall(
 		"call":                        call.Id,
 		"current_contract":            call.ContractId,
 		"current_account":             lua_current_account,
-		"get_current_account_balance": getCurrentAccountBalance,
-		"get_external_contract_data":  getExternalContractData,
+		"current_contract_owner":      lua_contract_owner,
+		"get_current_account_balance": cb.GetCurrentAccountBalance,
+		"send_from_account":           cb.SendFromAccount,
+		"hold_funds":                  cb.HoldFunds,
+		"capture_hold":                cb.CaptureHold,
+		"release_hold":                cb.ReleaseHold,
+		"get_external_contract_data":  cb.GetExternalContractData,
 		"call_external_method":        callExternalMethod,
+		"query_external_method":       queryExternalMethod,
 		"contract":                    contract.Id,
-		"get_contract_funds":          getContractFunds,
-		"send_from_contract":          sendFromContract,
+		"get_contract_funds":          cb.GetContractFunds,
+		"send_from_contract":          cb.SendFromContract,
+		"emit_event":                  cb.EmitEvent,
+		"schedule_call":               cb.ScheduleCall,
+		"storage_get":                 lua_storage_get,
+		"storage_set":                 lua_storage_set,
+		"storage_delete":              lua_storage_delete,
+		"storage_keys":                cb.ListStorageKeys,
+		"libraries":                   contract.Libraries,
+		"get_library_code":            cb.GetLibraryCode,
 		"httpgettext":                 lua_http_gettext,
 		"httpgetjson":                 lua_http_getjson,
 		"httppostjson":                lua_http_postjson,
@@ -133,6 +245,8 @@ func runCall(
 		"keybase_verify_bundle":       lua_keybase_verify_bundle,
 		"keybase_extract_message":     lua_keybase_extract_message,
 		"keybase_lookup":              lua_keybase_lookup,
+		"nostr_verify":                lua_nostr_verify,
+		"nostr_lookup":                lua_nostr_lookup,
 		"print": func(args ...interface{}) {
 			actualArgs := make([]interface{}, len(args)*2+1)
 			i := 0
@@ -153,13 +267,52 @@ func runCall(
 			actualArgs[i] = "\n"
 			fmt.Fprint(printToDestination, actualArgs...)
 		},
-		"sha256":        lua_sha256,
-		"cuid":          cuid.Slug,
-		"parse_bolt11":  lua_parse_bolt11,
-		"check_address": lua_check_btc_address,
+		"sha256":           lua_sha256,
+		"cuid":             make_lua_cuid(random),
+		"parse_bolt11":     lua_parse_bolt11,
+		"check_address":    lua_check_btc_address,
+		"json_encode":      lua_json_encode,
+		"json_decode":      lua_json_decode,
+		"verify_ecdsa":     lua_verify_ecdsa,
+		"verify_schnorr":   lua_verify_schnorr,
+		"verify_lnurlauth": lua_verify_lnurlauth,
+		"verify_lnmessage": lua_verify_lnmessage,
+		"call_time":        callTime.Unix(),
+		"date_to_time":     lua_date_to_time,
+		"random_float":     random.Float64,
+		"random_int":       make_lua_random_int(random),
+		"random_bytes":     cb.GetRandomBytes,
+		"meter_gas":        meterGas,
+		"gas_step":         gasStep,
 	})
 
-	code := `
+	err = L.DoString(sandboxCode)
+	if mem.exceeded() {
+		return nil, nil, gasUsed, errors.New("memory limit exceeded")
+	}
+	if err != nil {
+		st := stackTraceWithCode(err.Error(), actualCode)
+		err = errors.New(st)
+		return nil, nil, gasUsed, err
+	}
+
+	globalsAfter := lunatico.GetGlobals(L, "ret", "state")
+	stateAfter = globalsAfter["state"]
+	returned = globalsAfter["ret"]
+
+	// get state after method is run
+	if call.Method == "__init__" || call.Method == "__migrate__" {
+		// on __init__ calls the returned value is the initial state
+		// and on __migrate__ it is the state converted to the new code
+		stateAfter = returned
+	}
+
+	return stateAfter, returned, gasUsed, nil
+}
+
+// sandboxCode runs the contract code inside sandbox_env, the only globals a
+// contract can see are the ones in there.
+const sandboxCode = `
 -- account.id will be nil if there's not a logged user
 local account_id = nil
 if current_account ~= "" then
@@ -189,9 +342,45 @@ sandbox_env = {
       fmod = math.fmod, frexp = math.frexp, huge = math.huge,
       ldexp = math.ldexp, log = math.log, log10 = math.log10, max = math.max,
       min = math.min, modf = math.modf, pi = math.pi, pow = math.pow,
-      rad = math.rad, random = math.random, randomseed = math.randomseed,
-      sin = math.sin, sinh = math.sinh, sqrt = math.sqrt, tan = math.tan, tanh = math.tanh },
-  os = { clock = os.clock, difftime = os.difftime, time = os.time, date = os.date },
+      rad = math.rad, sin = math.sin, sinh = math.sinh, sqrt = math.sqrt,
+      tan = math.tan, tanh = math.tanh,
+      random = function (m, n)
+        if m == nil then
+          return random_float()
+        end
+        if n == nil then
+          m, n = 1, m
+        end
+        local r, err = random_int(m, n)
+        if err ~= nil then
+          error(err)
+        end
+        return math.tointeger(r)
+      end,
+      randomseed = function ()
+        error("math.randomseed is disabled, math.random is already seeded for each call")
+      end },
+  os = {
+    clock = function () return 0 end,
+    difftime = os.difftime,
+    time = function (date)
+      if date == nil then
+        return math.tointeger(call_time)
+      end
+      local t, err = date_to_time(date)
+      if err ~= nil then
+        error(err)
+      end
+      return math.tointeger(t)
+    end,
+    date = function (format, t)
+      format = format or "%c"
+      if string.sub(format, 1, 1) ~= "!" then
+        format = "!" .. format
+      end
+      return os.date(format, t or math.tointeger(call_time))
+    end
+  },
   http = {
     gettext = httpgettext,
     getjson = httpgetjson,
@@ -203,9 +392,23 @@ sandbox_env = {
     print = print,
     parse_bolt11 = parse_bolt11,
     check_address = check_address,
+    json_encode = json_encode,
+    json_decode = json_decode,
+    random_bytes = function (n)
+      local bytes, err = random_bytes(n)
+      if err ~= nil then
+        error(err)
+      end
+      return bytes
+    end,
+    verify_ecdsa = verify_ecdsa,
+    verify_schnorr = verify_schnorr,
+    verify_lnurlauth = verify_lnurlauth,
+    verify_lnmessage = verify_lnmessage,
   },
   contract = {
     id = current_contract,
+    owner = current_contract_owner,
     get_funds = function ()
       funds, err = get_contract_funds()
       if err ~= nil then
@@ -220,6 +423,67 @@ sandbox_env = {
       end
       return amt
     end,
+    emit = function (name, data)
+      local err = emit_event(name, data)
+      if err ~= nil then
+        error(err)
+      end
+    end,
+    schedule = function (method, payload, time)
+      local id, err = schedule_call(method, payload, time)
+      if err ~= nil then
+        error(err)
+      end
+      return id
+    end,
+    hold = function (account, amount, expiry)
+      local id, err = hold_funds(account, amount, expiry)
+      if err ~= nil then
+        error(err)
+      end
+      return id
+    end,
+    capture = function (id, amount)
+      local amt, err = capture_hold(id, amount)
+      if err ~= nil then
+        error(err)
+      end
+      return amt
+    end,
+    release = function (id)
+      local err = release_hold(id)
+      if err ~= nil then
+        error(err)
+      end
+    end,
+    storage = {
+      get = function (key)
+        local value, err = storage_get(key)
+        if err ~= nil then
+          error(err)
+        end
+        return value
+      end,
+      set = function (key, value)
+        local err = storage_set(key, value)
+        if err ~= nil then
+          error(err)
+        end
+      end,
+      delete = function (key)
+        local err = storage_delete(key)
+        if err ~= nil then
+          error(err)
+        end
+      end,
+      keys = function (prefix)
+        local keys, err = storage_keys(prefix or "")
+        if err ~= nil then
+          error(err)
+        end
+        return keys
+      end
+    },
     state = state
   },
   etleneum = {
@@ -231,10 +495,18 @@ sandbox_env = {
       return state, funds
     end,
     call_external = function (contract, method, payload, msatoshi)
-      local err = call_external_method(contract, method, payload, msatoshi)
+      local result, err = call_external_method(contract, method, payload, msatoshi)
       if err ~= nil then
         error(err)
       end
+      return result
+    end,
+    query = function (contract, method, payload)
+      local result, err = query_external_method(contract, method, payload)
+      if err ~= nil then
+        error(err)
+      end
+      return result
     end
   },
   account = {
@@ -246,6 +518,13 @@ sandbox_env = {
       end
       return balance
     end,
+    send = function (target, amount)
+      local amt, err = send_from_account(target, amount)
+      if err ~= nil then
+        error(err)
+      end
+      return amt
+    end,
   },
   call = {
     id = call,
@@ -271,37 +550,71 @@ sandbox_env = {
     username = function (n) return keybase.lookup("usernames", n) end,
     _verify = keybase_verify,
     _verify_bundle = keybase_verify_bundle,
+  },
+  nostr = {
+    verify = nostr_verify,
+    lookup = nostr_lookup,
+    tags = function (event, name)
+      local found = {}
+      for _, tag in ipairs(event.tags or {}) do
+        if tag[1] == name then
+          table.insert(found, tag)
+        end
+      end
+      return found
+    end,
+    tag = function (event, name)
+      for _, tag in ipairs(event.tags or {}) do
+        if tag[1] == name then
+          return tag[2]
+        end
+      end
+    end,
   }
 }
 
-_calls = 0
-function count ()
-  _calls = _calls + 1
-  if _calls > 1000 then
-    error('too many operations!')
+-- libraries are loaded in the same sandbox as the contract, but only the ones
+-- pinned when the contract was created can be used
+local loaded_libraries = {}
+sandbox_env.require = function (id)
+  local lib = loaded_libraries[id]
+  if lib == false then
+    error("circular require of library " .. id)
+  elseif lib ~= nil then
+    return lib
   end
-end
-debug.sethook(count, 'c')
 
-ret = load(code, 'call', 't', sandbox_env)()
-state = sandbox_env.contract.state
-    `
+  local hash = libraries[id]
+  if hash == nil then
+    error("library " .. tostring(id) .. " wasn't required when this contract was created")
+  end
 
-	err = L.DoString(code)
-	if err != nil {
-		st := stackTraceWithCode(err.Error(), actualCode)
-		err = errors.New(st)
-		return
-	}
+  local code, deps, err = get_library_code(id, hash)
+  if err ~= nil then
+    error(err)
+  end
+  for dep, dephash in pairs(deps) do
+    if libraries[dep] == nil then
+      libraries[dep] = dephash
+    end
+  end
 
-	globalsAfter := lunatico.GetGlobals(L, "ret", "state")
-	stateAfter = globalsAfter["state"]
+  loaded_libraries[id] = false
+  lib = load(code, id, 't', sandbox_env)()
+  if lib == nil then
+    lib = true
+  end
+  loaded_libraries[id] = lib
+  return lib
+end
 
-	// get state after method is run
-	if call.Method == "__init__" {
-		// on __init__ calls the returned value is the initial state
-		stateAfter = globalsAfter["ret"]
-	}
+debug.sethook(function ()
+  local err = meter_gas()
+  if err ~= nil then
+    error(err)
+  end
+end, '', gas_step)
 
-	return stateAfter, nil
-}
+ret = load(code, 'call', 't', sandbox_env)()
+state = sandbox_env.contract.state
+`
@@ -0,0 +1,158 @@
+package runlua
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/fiatjaf/go-lnurl"
+)
+
+// lua_verify_ecdsa checks a signature over sha256(msg). sig can be either
+// DER-encoded or a 64-byte compact r||s, pubkey must be a 33 or 65-byte key.
+func lua_verify_ecdsa(pubkey, msg, sig string) (ok bool, err error) {
+	bkey, err := hex.DecodeString(pubkey)
+	if err != nil {
+		return false, errors.New("pubkey is not valid hex")
+	}
+	bsig, err := hex.DecodeString(sig)
+	if err != nil {
+		return false, errors.New("signature is not valid hex")
+	}
+
+	pk, err := btcec.ParsePubKey(bkey, btcec.S256())
+	if err != nil {
+		return false, errors.New("invalid pubkey: " + err.Error())
+	}
+
+	var signature *btcec.Signature
+	if len(bsig) == 64 {
+		signature = &btcec.Signature{
+			R: new(big.Int).SetBytes(bsig[0:32]),
+			S: new(big.Int).SetBytes(bsig[32:64]),
+		}
+	} else {
+		signature, err = btcec.ParseDERSignature(bsig, btcec.S256())
+		if err != nil {
+			return false, errors.New("invalid signature: " + err.Error())
+		}
+	}
+
+	hash := sha256.Sum256([]byte(msg))
+	return signature.Verify(hash[:], pk), nil
+}
+
+// lua_verify_schnorr checks a BIP-340 signature. pubkey is the 32-byte x-only
+// key and msg is the hex-encoded message (usually a 32-byte hash, like a
+// nostr event id).
+func lua_verify_schnorr(pubkey, msg, sig string) (ok bool, err error) {
+	bkey, err := hex.DecodeString(pubkey)
+	if err != nil || len(bkey) != 32 {
+		return false, errors.New("pubkey must be 32 bytes of hex")
+	}
+	bmsg, err := hex.DecodeString(msg)
+	if err != nil {
+		return false, errors.New("message is not valid hex")
+	}
+	bsig, err := hex.DecodeString(sig)
+	if err != nil || len(bsig) != 64 {
+		return false, errors.New("signature must be 64 bytes of hex")
+	}
+
+	return verifySchnorr(bkey, bmsg, bsig), nil
+}
+
+func verifySchnorr(pubkey, msg, sig []byte) bool {
+	curve := btcec.S256()
+
+	// lift_x: the even y is the one with the 0x02 prefix
+	pk, err := btcec.ParsePubKey(append([]byte{0x02}, pubkey...), curve)
+	if err != nil {
+		return false
+	}
+
+	r := new(big.Int).SetBytes(sig[0:32])
+	s := new(big.Int).SetBytes(sig[32:64])
+	if r.Cmp(curve.P) >= 0 || s.Cmp(curve.N) >= 0 {
+		return false
+	}
+
+	// e = int(hash_BIP0340/challenge(bytes(r) || bytes(P) || m)) mod n
+	e := new(big.Int).SetBytes(taggedHash("BIP0340/challenge", sig[0:32], pubkey, msg))
+	e.Mod(e, curve.N)
+
+	// R = s*G - e*P
+	sGx, sGy := curve.ScalarBaseMult(sig[32:64])
+	ePx, ePy := curve.ScalarMult(pk.X, pk.Y, e.Bytes())
+	ePy.Sub(curve.P, ePy)
+	Rx, Ry := curve.Add(sGx, sGy, ePx, ePy)
+
+	if Rx.Sign() == 0 && Ry.Sign() == 0 {
+		return false
+	}
+	if Ry.Bit(0) != 0 {
+		return false
+	}
+	return Rx.Cmp(r) == 0
+}
+
+func taggedHash(tag string, msgs ...[]byte) []byte {
+	tagHash := sha256.Sum256([]byte(tag))
+	h := sha256.New()
+	h.Write(tagHash[:])
+	h.Write(tagHash[:])
+	for _, msg := range msgs {
+		h.Write(msg)
+	}
+	return h.Sum(nil)
+}
+
+// lua_verify_lnmessage checks a signature made by a lightning node with
+// signmessage: a zbase32-encoded recoverable signature over
+// sha256(sha256("Lightning Signed Message:" + msg)). pubkey is the hex node id.
+func lua_verify_lnmessage(pubkey, msg, sig string) (ok bool, err error) {
+	bsig, err := zbase32Decode(sig)
+	if err != nil || len(bsig) != 65 {
+		return false, errors.New("signature must be 65 bytes of zbase32")
+	}
+
+	first := sha256.Sum256([]byte("Lightning Signed Message:" + msg))
+	hash := sha256.Sum256(first[:])
+	pk, _, err := btcec.RecoverCompact(btcec.S256(), bsig, hash[:])
+	if err != nil {
+		return false, nil
+	}
+
+	return hex.EncodeToString(pk.SerializeCompressed()) == strings.ToLower(pubkey), nil
+}
+
+const zbase32Alphabet = "ybndrfg8ejkmcpqxot1uwisza345h769"
+
+func zbase32Decode(s string) ([]byte, error) {
+	var out []byte
+	var acc uint
+	var bits uint
+	for _, c := range s {
+		v := strings.IndexRune(zbase32Alphabet, c)
+		if v < 0 {
+			return nil, errors.New("invalid zbase32 character")
+		}
+		acc = acc<<5 | uint(v)
+		bits += 5
+		if bits >= 8 {
+			bits -= 8
+			out = append(out, byte(acc>>bits))
+			acc &= 1<<bits - 1
+		}
+	}
+	return out, nil
+}
+
+// lua_verify_lnurlauth checks a signature from an lnurl-auth linking key,
+// exactly as a service would do on its lnurl-auth callback.
+func lua_verify_lnurlauth(k1, sig, key string) (ok bool, err error) {
+	return lnurl.VerifySignature(k1, sig, key)
+}
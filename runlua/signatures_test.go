@@ -0,0 +1,177 @@
+package runlua
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// the verification vectors from
+// https://github.com/bitcoin/bips/blob/master/bip-0340/test-vectors.csv
+func TestVerifySchnorr(t *testing.T) {
+	for i, tc := range []struct {
+		pubkey   string
+		msg      string
+		sig      string
+		expected bool
+	}{
+		{
+			"F9308A019258C31049344F85F89D5229B531C845836F99B08601F113BCE036F9",
+			"0000000000000000000000000000000000000000000000000000000000000000",
+			"E907831F80848D1069A5371B402410364BDF1C5F8307B0084C55F1CE2DCA821525F66A4A85EA8B71E482A74F382D2CE5EBEEE8FDB2172F477DF4900D310536C0",
+			true,
+		}, // 0
+		{
+			"DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659",
+			"243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89",
+			"6896BD60EEAE296DB48A229FF71DFE071BDE413E6D43F917DC8DCF8C78DE33418906D11AC976ABCCB20B091292BFF4EA897EFCB639EA871CFA95F6DE339E4B0A",
+			true,
+		}, // 1
+		{
+			"DD308AFEC5777E13121FA72B9CC1B7CC0139715309B086C960E18FD969774EB8",
+			"7E2D58D8B3BCDF1ABADEC7829054F90DDA9805AAB56C77333024B9D0A508B75C",
+			"5831AAEED7B44BB74E5EAB94BA9D4294C49BCF2A60728D8B4C200F50DD313C1BAB745879A5AD954A72C45A91C3A51D3C7ADEA98D82F8481E0E1E03674A6F3FB7",
+			true,
+		}, // 2
+		{
+			"25D1DFF95105F5253C4022F628A996AD3A0D95FBF21D468A1B33F8C160D8F517",
+			"FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF",
+			"7EB0509757E246F19449885651611CB965ECC1A187DD51B64FDA1EDC9637D5EC97582B9CB13DB3933705B32BA982AF5AF25FD78881EBB32771FC5922EFC66EA3",
+			true,
+		}, // 3: test fails if msg is reduced modulo p or n
+		{
+			"D69C3509BB99E412E68B0FE8544E72837DFA30746D8BE2AA65975F29D22DC7B9",
+			"4DF3C3F68FCC83B27E9D42C90431A72499F17875C81A599B566C9889B9696703",
+			"00000000000000000000003B78CE563F89A0ED9414F5AA28AD0D96D6795F9C6376AFB1548AF603B3EB45C9F8207DEE1060CB71C04E80F593060B07D28308D7F4",
+			true,
+		}, // 4
+		{
+			"EEFDEA4CDB677750A420FEE807EACF21EB9898AE79B9768766E4FAA04A2D4A34",
+			"243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89",
+			"6CFF5C3BA86C69EA4B7376F31A9BCB4F74C1976089B2D9963DA2E5543E17776969E89B4C5564D00349106B8497785DD7D1D713A8AE82B32FA79D5F7FC407D39B",
+			false,
+		}, // 5: public key not on the curve
+		{
+			"DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659",
+			"243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89",
+			"FFF97BD5755EEEA420453A14355235D382F6472F8568A18B2F057A14602975563CC27944640AC607CD107AE10923D9EF7A73C643E166BE5EBEAFA34B1AC553E2",
+			false,
+		}, // 6: has_even_y(R) is false
+		{
+			"DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659",
+			"243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89",
+			"1FA62E331EDBC21C394792D2AB1100A7B432B013DF3F6FF4F99FCB33E0E1515F28890B3EDB6E7189B630448B515CE4F8622A954CFE545735AAEA5134FCCDB2BD",
+			false,
+		}, // 7: negated message
+		{
+			"DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659",
+			"243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89",
+			"6CFF5C3BA86C69EA4B7376F31A9BCB4F74C1976089B2D9963DA2E5543E177769961764B3AA9B2FFCB6EF947B6887A226E8D7C93E00C5ED0C1834FF0D0C2E6DA6",
+			false,
+		}, // 8: negated s value
+		{
+			"DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659",
+			"243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89",
+			"0000000000000000000000000000000000000000000000000000000000000000123DDA8328AF9C23A94C1FEECFD123BA4FB73476F0D594DCB65C6425BD186051",
+			false,
+		}, // 9: sG - eP is infinite, x(inf) as 0
+		{
+			"DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659",
+			"243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89",
+			"00000000000000000000000000000000000000000000000000000000000000017615FBAF5AE28864013C099742DEADB4DBA87F11AC6754F93780D5A1837CF197",
+			false,
+		}, // 10: sG - eP is infinite, x(inf) as 1
+		{
+			"DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659",
+			"243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89",
+			"4A298DACAE57395A15D0795DDBFD1DCB564DA82B0F269BC70A74F8220429BA1D69E89B4C5564D00349106B8497785DD7D1D713A8AE82B32FA79D5F7FC407D39B",
+			false,
+		}, // 11: sig[0:32] is not an X coordinate on the curve
+		{
+			"DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659",
+			"243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89",
+			"FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEFFFFFC2F69E89B4C5564D00349106B8497785DD7D1D713A8AE82B32FA79D5F7FC407D39B",
+			false,
+		}, // 12: sig[0:32] is equal to field size
+		{
+			"DFF1D77F2A671C5F36183726DB2341BE58FEAE1DA2DECED843240F7B502BA659",
+			"243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89",
+			"6CFF5C3BA86C69EA4B7376F31A9BCB4F74C1976089B2D9963DA2E5543E177769FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEBAAEDCE6AF48A03BBFD25E8CD0364141",
+			false,
+		}, // 13: sig[32:64] is equal to curve order
+		{
+			"FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFEFFFFFC30",
+			"243F6A8885A308D313198A2E03707344A4093822299F31D0082EFA98EC4E6C89",
+			"6CFF5C3BA86C69EA4B7376F31A9BCB4F74C1976089B2D9963DA2E5543E17776969E89B4C5564D00349106B8497785DD7D1D713A8AE82B32FA79D5F7FC407D39B",
+			false,
+		}, // 14: public key exceeds the field size
+	} {
+		ok, err := lua_verify_schnorr(tc.pubkey, tc.msg, tc.sig)
+		if err != nil {
+			t.Errorf("vector %d: %s", i, err)
+		} else if ok != tc.expected {
+			t.Errorf("vector %d: got %v, expected %v", i, ok, tc.expected)
+		}
+	}
+}
+
+func zbase32Encode(b []byte) string {
+	var out strings.Builder
+	var acc uint
+	var bits uint
+	for _, c := range b {
+		acc = acc<<8 | uint(c)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			out.WriteByte(zbase32Alphabet[acc>>bits&31])
+		}
+	}
+	if bits > 0 {
+		out.WriteByte(zbase32Alphabet[acc<<(5-bits)&31])
+	}
+	return out.String()
+}
+
+func TestVerifyLightningMessage(t *testing.T) {
+	key, _ := btcec.PrivKeyFromBytes(btcec.S256(), sha256.New().Sum(nil))
+	pubkey := hex.EncodeToString(key.PubKey().SerializeCompressed())
+
+	// what signmessage does
+	first := sha256.Sum256([]byte("Lightning Signed Message:hello"))
+	hash := sha256.Sum256(first[:])
+	bsig, err := btcec.SignCompact(btcec.S256(), key, hash[:], true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := zbase32Encode(bsig)
+
+	if decoded, _ := zbase32Decode(sig); hex.EncodeToString(decoded) != hex.EncodeToString(bsig) {
+		t.Fatalf("zbase32 doesn't round trip: %x != %x", decoded, bsig)
+	}
+
+	for _, tc := range []struct {
+		pubkey   string
+		msg      string
+		expected bool
+	}{
+		{pubkey, "hello", true},
+		{strings.ToUpper(pubkey), "hello", true},
+		{pubkey, "hellO", false},
+		{"02" + strings.Repeat("11", 32), "hello", false},
+	} {
+		ok, err := lua_verify_lnmessage(tc.pubkey, tc.msg, sig)
+		if err != nil {
+			t.Errorf("%s %s: %s", tc.pubkey, tc.msg, err)
+		} else if ok != tc.expected {
+			t.Errorf("%s %s: got %v, expected %v", tc.pubkey, tc.msg, ok, tc.expected)
+		}
+	}
+
+	if _, err := lua_verify_lnmessage(pubkey, "hello", "not zbase32!"); err == nil {
+		t.Error("expected an error for an invalid signature")
+	}
+}
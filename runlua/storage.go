@@ -0,0 +1,65 @@
+package runlua
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/fiatjaf/etleneum/data"
+)
+
+const (
+	maxStorageKeyLength = 200
+	maxStorageFileName  = 255 // most filesystems won't take more
+)
+
+// checkStorageKey runs before the callbacks, so a key that can't be saved
+// fails the call at the line that has used it, not only when it is committed.
+func checkStorageKey(key string) error {
+	if key == "" {
+		return errors.New("storage key can't be blank")
+	}
+	if len(key) > maxStorageKeyLength ||
+		len(data.StorageKeyFile(key)) > maxStorageFileName {
+		return errors.New("storage key is too long")
+	}
+	if strings.ContainsAny(key, "/\\\x00") {
+		return errors.New("storage key can't have slashes or null bytes")
+	}
+	return nil
+}
+
+func make_lua_storage(
+	getStorage func(key string) (interface{}, error),
+	setStorage func(key string, value interface{}) error,
+	deleteStorage func(key string) error,
+) (
+	lua_storage_get func(string) (interface{}, error),
+	lua_storage_set func(string, interface{}) error,
+	lua_storage_delete func(string) error,
+) {
+	lua_storage_get = func(key string) (interface{}, error) {
+		if err := checkStorageKey(key); err != nil {
+			return nil, err
+		}
+		return getStorage(key)
+	}
+
+	lua_storage_set = func(key string, value interface{}) error {
+		if err := checkStorageKey(key); err != nil {
+			return err
+		}
+		if value == nil {
+			return deleteStorage(key)
+		}
+		return setStorage(key, value)
+	}
+
+	lua_storage_delete = func(key string) error {
+		if err := checkStorageKey(key); err != nil {
+			return err
+		}
+		return deleteStorage(key)
+	}
+
+	return
+}
@@ -0,0 +1,33 @@
+package runlua
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckStorageKey(t *testing.T) {
+	for _, tc := range []struct {
+		key string
+		ok  bool
+	}{
+		{"a", true},
+		{"user:123", true},
+		{"çã⚡", true},
+		{strings.Repeat("a", 200), true},
+		{"", false},
+		{strings.Repeat("a", 201), false},
+		// fits in 200 bytes, but not in a file name once escaped
+		{strings.Repeat("⚡", 30), false},
+		{"a/b", false},
+		{"../state", false},
+		{"a\\b", false},
+		{"a\x00b", false},
+	} {
+		err := checkStorageKey(tc.key)
+		if tc.ok && err != nil {
+			t.Errorf("%q should be accepted, got %s", tc.key, err)
+		} else if !tc.ok && err == nil {
+			t.Errorf("%q should be rejected", tc.key)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/fiatjaf/etleneum/data"
+	"github.com/lucsky/cuid"
+)
+
+func startScheduler() {
+	go func() {
+		for {
+			time.Sleep(10 * time.Second)
+			releaseExpiredHolds()
+			runDueSchedules()
+		}
+	}()
+}
+
+// releaseExpiredHolds releases the holds that have expired, one at a time.
+// they are listed under the data lock so calls running at the same time can't
+// capture or release them in between.
+func releaseExpiredHolds() {
+	tried := make(map[string]bool)
+	for {
+		data.Start()
+		holds, err := data.ListExpiredHolds(time.Now())
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to list expired holds")
+			data.Unlock()
+			return
+		}
+
+		var next *data.Hold
+		for i := range holds {
+			if !tried[holds[i].Id] {
+				next = &holds[i]
+				break
+			}
+		}
+		if next == nil {
+			data.Unlock()
+			return
+		}
+
+		// a hold that fails to be released is tried again on the next round
+		tried[next.Id] = true
+		releaseExpiredHold(*next)
+	}
+}
+
+// runDueSchedules runs the scheduled calls that are due, one at a time, and
+// like the holds they are listed under the data lock.
+func runDueSchedules() {
+	tried := make(map[string]bool)
+	for {
+		data.Start()
+		schedules, err := data.ListDueSchedules(time.Now())
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to list scheduled calls")
+			data.Unlock()
+			return
+		}
+
+		var next *data.Schedule
+		for i := range schedules {
+			if !tried[schedules[i].Id] {
+				next = &schedules[i]
+				break
+			}
+		}
+		if next == nil {
+			data.Unlock()
+			return
+		}
+
+		tried[next.Id] = true
+		runScheduledCall(*next)
+	}
+}
+
+// scheduledCall is the call made when a schedule is due. the contract is the
+// caller and pays for the call with its own funds.
+func scheduledCall(sch data.Schedule) *data.Call {
+	call := &data.Call{
+		Id:         "r" + cuid.Slug(),
+		ContractId: sch.ContractId,
+		Method:     sch.Method,
+		Payload:    sch.Payload,
+		Caller:     sch.ContractId,
+	}
+	call.Cost = getCallCosts(*call, false)
+	return call
+}
+
+// runScheduledCall must be called with the data lock held, it is released
+// when the call is done.
+func runScheduledCall(sch data.Schedule) {
+	logger := log.With().Str("ctid", sch.ContractId).Str("schedule", sch.Id).Logger()
+
+	call := scheduledCall(sch)
+	logger = logger.With().Str("callid", call.Id).Str("method", call.Method).Logger()
+
+	logger.Info().Interface("call", call).Msg("scheduled call being made")
+
+	err := data.DeleteSchedule(sch.ContractId, sch.Id)
+	if err == nil {
+		err = runCallGlobal(context.Background(), call, true)
+	}
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to run scheduled call")
+		data.Abort()
+		dispatchContractEvent(call.ContractId,
+			ctevent{call.Id, call.ContractId, call.Method, call.Msatoshi, err.Error(), "runtime"},
+			"call-error")
+
+		// the schedule is gone anyway, otherwise it would be retried forever
+		data.Start()
+		if err := data.DeleteSchedule(sch.ContractId, sch.Id); err != nil {
+			logger.Error().Err(err).Msg("failed to delete failed scheduled call")
+			data.Abort()
+			return
+		}
+		data.Finish("scheduled " + call.Method + " " + sch.Id + " has failed on contract " + call.ContractId + ".")
+		return
+	}
+
+	// commit
+	data.Finish("scheduled " + call.Method + " " + call.Id + " executed on contract " + call.ContractId + ".")
+
+	dispatchContractEvent(call.ContractId,
+		callmadeevent{
+			ctevent{call.Id, call.ContractId, call.Method, call.Msatoshi, "", ""},
+			call.Result,
+		}, "call-made")
+}
+
+// releaseExpiredHold gives the funds held by a contract back to the account.
+// like runScheduledCall, it must be called with the data lock held.
+func releaseExpiredHold(hold data.Hold) {
+	logger := log.With().Str("ctid", hold.ContractId).Str("hold", hold.Id).
+		Str("account", hold.Account).Int64("msatoshi", hold.Msatoshi).Logger()
+
+	balance := data.GetAccountBalance(hold.Account)
+	err := data.SaveAccountBalance(hold.Account, balance+hold.Msatoshi)
+	if err == nil {
+		err = data.DeleteHold(hold.Account, hold.Id)
+	}
+	if err == nil {
+		err = data.SaveExpiredHold(hold)
+	}
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed to release expired hold")
+		data.Abort()
+		return
+	}
+
+	data.Finish("hold " + hold.Id + " from contract " + hold.ContractId + " has expired.")
+	logger.Info().Msg("expired hold released")
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/etleneum/data"
+)
+
+// testDatabase points the data package to an empty git database. it is left
+// there after the test as commits push to it in the background.
+func testDatabase(t *testing.T) {
+	t.Helper()
+
+	data.DatabasePath = t.TempDir()
+	data.SetLogger(&log)
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"config", "user.name", "test"},
+		{"config", "user.email", "test@localhost"},
+		{"commit", "-q", "--allow-empty", "-m", "init"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = data.DatabasePath
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s %s", args, err, out)
+		}
+	}
+	os.MkdirAll(filepath.Join(data.DatabasePath, "accounts"), 0o700)
+	os.MkdirAll(filepath.Join(data.DatabasePath, "contracts"), 0o700)
+}
+
+func TestScheduledCallCost(t *testing.T) {
+	defer func(previous Settings) { s = previous }(s)
+	s.FixedCallCostSatoshis = 1
+	s.CallGasLimit = 10000000
+	s.MillionGasCostSatoshis = 2
+
+	call := scheduledCall(data.Schedule{
+		Id:         "sabc-0",
+		ContractId: "cabc",
+		Method:     "tick",
+		Payload:    []byte(`{"n":1}`),
+	})
+
+	if call.Caller != "cabc" {
+		t.Errorf("scheduled call should be made by the contract, got %s", call.Caller)
+	}
+
+	// the fixed cost, the payload and the full gas budget
+	expected := int64(1000 + 10*len(`{"n":1}`) + 20000)
+	if call.Cost != expected {
+		t.Errorf("got cost %d, expected %d", call.Cost, expected)
+	}
+}
+
+func TestReleaseExpiredHolds(t *testing.T) {
+	testDatabase(t)
+
+	account := "0account"
+	data.Start()
+	data.SaveAccountBalance(account, 1000)
+	for _, hold := range []data.Hold{
+		{Id: "hexpired-0", ContractId: "cabc", Account: account, Msatoshi: 3000,
+			Expiry: time.Now().Add(-time.Minute), Call: "rexpired"},
+		{Id: "hvalid-0", ContractId: "cabc", Account: account, Msatoshi: 500,
+			Expiry: time.Now().Add(time.Hour), Call: "rvalid"},
+	} {
+		if err := data.SaveHold(hold); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data.Finish("setup")
+
+	releaseExpiredHolds()
+
+	if balance := data.GetAccountBalance(account); balance != 4000 {
+		t.Errorf("got balance %d, expected 4000", balance)
+	}
+	holds, _ := data.ListHolds(account)
+	if len(holds) != 1 || holds[0].Id != "hvalid-0" {
+		t.Errorf("only the valid hold should be left, got %v", holds)
+	}
+
+	csv, err := ioutil.ReadFile(filepath.Join(data.DatabasePath,
+		"contracts", "cabc", "holds", "hexpired-0", "transfers.csv"))
+	if err != nil {
+		t.Fatalf("the release wasn't recorded: %s", err)
+	}
+	transfers := data.ParseTransfers(csv)
+	if len(transfers) != 1 || transfers[0] != (data.Transfer{
+		From: "hexpired-0", To: account, Msatoshi: 3000,
+	}) {
+		t.Errorf("unexpected transfers %v", transfers)
+	}
+
+	// the lock is free again and there is nothing else to do
+	releaseExpiredHolds()
+	runDueSchedules()
+	if balance := data.GetAccountBalance(account); balance != 4000 {
+		t.Errorf("got balance %d after another round, expected 4000", balance)
+	}
+}
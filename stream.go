@@ -18,7 +18,19 @@ type ctevent struct {
 	Kind       string `json:"kind,omitempty"`
 }
 
-func dispatchContractEvent(contractId string, ev ctevent, typ string) {
+type callmadeevent struct {
+	ctevent
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+type emittedevent struct {
+	Id         string          `json:"id"`
+	ContractId string          `json:"contract_id"`
+	Name       string          `json:"name"`
+	Data       json.RawMessage `json:"data"`
+}
+
+func dispatchContractEvent(contractId string, ev interface{}, typ string) {
 	jpayload, _ := json.Marshal(ev)
 	payload := string(jpayload)
 
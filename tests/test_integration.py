@@ -1,4 +1,7 @@
+import os
+import hmac
 import json
+import time
 import datetime
 import urllib3
 import hashlib
@@ -68,6 +71,10 @@ function cashout_wrong ()
   contract.send(nil, call.payload.amt_to_cashout)
 end
 
+function balanceof ()
+  return contract.state.balances[call.payload.user] or 0
+end
+
 function return23 () return 23 end
 
 local just23 = 23
@@ -108,6 +115,29 @@ hG89/FmpOuSJgmxSoQgCsgPYuwqvcUpXx6sACJE1Zn4lyrDbi4zRH97cDKVhfjI=
   }
 end
 
+function note ()
+  contract.storage.set('note:' .. call.payload.key, call.payload.value)
+end
+
+function relay ()
+  return etleneum.call_external(call.payload.target, 'echo', {msg='hi'}, 0)
+end
+
+function announce ()
+  contract.emit('announcement', {msg=call.payload.msg})
+end
+
+function reserve ()
+  return contract.hold(account.id, call.payload.msatoshi, os.time() + call.payload.seconds)
+end
+
+function settle ()
+  if call.payload.capture then
+    return contract.capture(call.payload.hold, call.payload.capture)
+  end
+  contract.release(call.payload.hold)
+end
+
 function losemoney ()
   -- do nothing, just eat the satoshis sent with the call
 end
@@ -303,6 +333,22 @@ end
         assert r.ok
         assert len(r.json()["value"]) == current_call_n
 
+    # query a balance without paying, through the query string or the body
+    r = requests.get(url + "/~/contract/" + ctid + "/query/balanceof?user=y")
+    assert r.ok
+    assert r.json()["value"] == 2
+    r = requests.post(
+        url + "/~/contract/" + ctid + "/query/balanceof", json={"user": "x"}
+    )
+    assert r.ok
+    assert r.json()["value"] == 0
+    r = requests.get(url + "/~/contract/" + ctid + "/query/_private")
+    assert r.status_code == 400
+
+    ## queries are not saved as calls
+    r = requests.get(url + "/~/contract/" + ctid + "/calls")
+    assert len(r.json()["value"]) == current_call_n
+
     # try to cash out to our own scammer balance
     ## fail because of too big amount
     r = requests.post(
@@ -421,6 +467,185 @@ end
         "userdoesntexist": False,
     }
 
+    # create another contract and call it from the first
+    r = requests.post(
+        url + "/~/contract",
+        json={
+            "name": "echo",
+            "readme": "returns what it gets",
+            "code": """
+function __init__ ()
+  return {}
+end
+
+function echo ()
+  return call.payload
+end
+            """,
+        },
+    )
+    assert r.ok
+    echoid = r.json()["value"]["id"]
+    echosse = sseclient.SSEClient(
+        urllib3.PoolManager().request(
+            "GET", url + "/~~~/contract/" + echoid, preload_content=False
+        )
+    ).events()
+    rpc_b.pay(r.json()["value"]["invoice"])
+    assert next(echosse).event == "call-run-event"
+    assert next(echosse).event == "contract-created"
+
+    r = requests.post(
+        url + "/~/contract/" + ctid + "/call",
+        json={
+            "method": "relay",
+            "payload": {"target": echoid},
+            "msatoshi": 1000,
+            "parent": {"contract_id": echoid, "id": "rforged"},
+        },
+    )
+    relayid = r.json()["value"]["id"]
+    rpc_b.pay(r.json()["value"]["invoice"])
+    assert next(sse).event == "call-run-event"
+    assert next(sse).event == "call-made"
+
+    r = requests.get(url + "/~/contract/" + ctid + "/call/" + relayid + "/tree")
+    assert r.ok
+    tree = r.json()["value"]
+    assert "parent" not in tree
+    assert tree["result"] == {"msg": "hi"}
+    assert len(tree["calls"]) == 1
+    assert tree["calls"][0]["contract_id"] == echoid
+    assert tree["calls"][0]["method"] == "echo"
+    assert tree["calls"][0]["result"] == {"msg": "hi"}
+    assert tree["calls"][0]["parent"] == {"contract_id": ctid, "id": relayid}
+    assert tree["calls"][0]["calls"] == []
+
+    # emit events, the ones sent along with the call are ignored
+    for msg in ["first", "second"]:
+        r = requests.post(
+            url + "/~/contract/" + ctid + "/call",
+            json={
+                "method": "announce",
+                "payload": {"msg": msg},
+                "events": [{"name": "forged", "data": {}}],
+            },
+        )
+        rpc_b.pay(r.json()["value"]["invoice"])
+        assert next(sse).event == "call-run-event"
+        assert next(sse).event == "contract-event"
+        assert next(sse).event == "call-made"
+
+    r = requests.get(url + "/~/contract/" + ctid + "/events")
+    assert r.ok
+    events = r.json()["value"]
+    assert len(events) == 2
+    assert sorted(e["data"]["msg"] for e in events) == ["first", "second"]
+    assert all(e["name"] == "announcement" for e in events)
+    r = requests.get(url + "/~/contract/" + ctid + "/events?limit=1")
+    assert len(r.json()["value"]) == 1
+    r = requests.get(url + "/~/contract/" + ctid + "/events?name=forged")
+    assert r.json()["value"] == []
+
+    # save things in the contract storage, then delete one
+    for key, value in [("a", {"x": 1}), ("b", "hi"), ("a", None)]:
+        r = requests.post(
+            url + "/~/contract/" + ctid + "/call",
+            json={"method": "note", "payload": {"key": key, "value": value}},
+        )
+        rpc_b.pay(r.json()["value"]["invoice"])
+        assert next(sse).event == "call-run-event"
+        assert next(sse).event == "call-made"
+
+    r = requests.get(url + "/~/contract/" + ctid + "/storage?prefix=note:")
+    assert r.ok
+    assert r.json()["value"] == ["note:b"]
+    r = requests.get(url + "/~/contract/" + ctid + "/storage/note:b")
+    assert r.json()["value"] == "hi"
+    r = requests.get(url + "/~/contract/" + ctid + "/storage/note:a")
+    assert r.status_code == 404
+
+    # hold funds from our account, then release, capture or let them expire
+    def reserve(seconds):
+        r = requests.post(
+            url + "/~/contract/" + ctid + "/call?session=zxcasdqwe",
+            json={
+                "method": "reserve",
+                "payload": {"msatoshi": 3000, "seconds": seconds},
+            },
+        )
+        callid = r.json()["value"]["id"]
+        rpc_b.pay(r.json()["value"]["invoice"])
+        assert next(sse).event == "call-run-event"
+        assert next(sse).event == "call-run-event"
+        assert next(sse).event == "call-made"
+        r = requests.get(url + "/~/contract/" + ctid + "/call/" + callid)
+        holdid = r.json()["value"]["result"]
+        assert holdid == "h" + callid[1:] + "-0"
+        return holdid
+
+    def settle(payload, succeed=True):
+        r = requests.post(
+            url + "/~/contract/" + ctid + "/call",
+            json={"method": "settle", "payload": payload},
+        )
+        callid = r.json()["value"]["id"]
+        rpc_b.pay(r.json()["value"]["invoice"])
+        assert next(sse).event == "call-run-event"
+        if not succeed:
+            assert next(sse).event == "call-error"
+            return
+        assert next(sse).event == "call-run-event"
+        assert next(sse).event == "call-made"
+        r = requests.get(url + "/~/contract/" + ctid + "/call/" + callid)
+        return r.json()["value"]["transfers"]
+
+    funds = requests.get(url + "/~/contract/" + ctid + "/funds").json()["value"]
+
+    ## released, everything goes back to the account
+    holdid = reserve(3600)
+    transfers = settle({"hold": holdid})
+    assert {"from": holdid, "to": "account1", "msatoshi": 3000} in transfers
+    settle({"hold": holdid}, succeed=False)
+
+    ## captured, the rest goes back to the account
+    holdid = reserve(3600)
+    transfers = settle({"hold": holdid, "capture": 1000})
+    assert {"from": "account1", "to": ctid, "msatoshi": 1000} in transfers
+    assert {"from": holdid, "to": "account1", "msatoshi": 2000} in transfers
+    r = requests.get(url + "/~/contract/" + ctid + "/funds")
+    assert r.json()["value"] == funds + 1000
+    current_funds -= 1000  # our scammer balance
+
+    ## expired, the scheduler gives everything back
+    holdid = reserve(1)
+    time.sleep(15)
+    settle({"hold": holdid}, succeed=False)
+
+    # lnurls made on behalf of an account can only be used once
+    def reserve_lnurl(nonce, expiry):
+        payload = {"msatoshi": 3000, "seconds": 3600}
+        serialized = "{}:reserve:0:{}:{},".format(ctid, nonce, expiry) + "".join(
+            "{}={},".format(k, payload[k]) for k in sorted(payload)
+        )
+        secret = hashlib.sha256(
+            ("account1-" + os.getenv("SECRET_KEY")).encode("utf-8")
+        ).hexdigest()
+        mac = hmac.new(
+            secret.encode("utf-8"), serialized.encode("utf-8"), hashlib.sha256
+        ).hexdigest()
+        return requests.get(
+            url + "/lnurl/contract/" + ctid + "/call/reserve/0",
+            params=dict(
+                payload, _account="account1", _nonce=nonce, _expiry=expiry, _hmac=mac
+            ),
+        ).json()
+
+    expiry = int(time.time()) + 600
+    assert reserve_lnurl("once", expiry)["tag"] == "payRequest"
+    assert reserve_lnurl("once", expiry)["status"] == "ERROR"
+    assert reserve_lnurl("expired", int(time.time()) - 1)["status"] == "ERROR"
+
     # send a lot of money to the contract so we can have incoming capacity in our second node for the next step
     r = requests.post(
         url + "/~/contract/" + ctid + "/call",